@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/logs"
+	"github.com/qup42/loghead/ssh"
+	"github.com/qup42/loghead/types"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs a maintenance command instead of the server.
+func runCommand(c *types.Config, args []string) error {
+	switch args[0] {
+	case "deadletter":
+		return runDeadLetterCommand(c, args[1:])
+	case "script":
+		return runScriptCommand(c, args[1:])
+	case "recordings":
+		return runRecordingsCommand(c, args[1:])
+	default:
+		return errors.Errorf("unknown command %s", args[0])
+	}
+}
+
+func runDeadLetterCommand(c *types.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: loghead deadletter list|resubmit [-target url] [id...]")
+	}
+	dl := &logs.DeadLetterService{Dir: c.Loghead.DeadLetter.Dir}
+	switch args[0] {
+	case "list":
+		ds, err := dl.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCOLLECTION\tPRIVATE ID\tSIZE\tERROR")
+		for _, d := range ds {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", d.ID, d.Collection, d.PrivateID, d.Size, d.Error)
+		}
+		return tw.Flush()
+	case "resubmit":
+		fs := flag.NewFlagSet("resubmit", flag.ContinueOnError)
+		target := fs.String("target", resubmitTarget(c.Loghead.Listener), "address of the loghead instance to submit the batches to")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *target == "" {
+			return errors.Errorf("-target is required for a %s listener", c.Loghead.Listener.Type)
+		}
+		ids := fs.Args()
+		if len(ids) == 0 {
+			ds, err := dl.List()
+			if err != nil {
+				return err
+			}
+			for _, d := range ds {
+				ids = append(ids, d.ID)
+			}
+		}
+		var errs error
+		for _, id := range ids {
+			if err := resubmitDeadLetter(dl, *target, id); err != nil {
+				log.Error().Err(err).Msgf("Resubmitting %s failed", id)
+				errs = errors.Join(errs, err)
+				continue
+			}
+			log.Info().Msgf("Resubmitted %s", id)
+		}
+		return errs
+	default:
+		return errors.Errorf("unknown deadletter command %s", args[0])
+	}
+}
+
+// resubmitTarget returns the address of the client logs listener on this host.
+// A tsnet listener is only reachable over the tailnet, its address has to be given.
+func resubmitTarget(c types.ListenerConfig) string {
+	if c.Type != "plain" {
+		return ""
+	}
+	host := c.Addr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, c.Port)
+}
+
+// resubmitDeadLetter uploads the batch again and deletes it if the upload was accepted.
+func resubmitDeadLetter(dl *logs.DeadLetterService, target string, id string) error {
+	d, err := dl.Get(id)
+	if err != nil {
+		return err
+	}
+	b, err := dl.Body(id)
+	if err != nil {
+		return err
+	}
+	u, err := url.JoinPath(target, "c", d.Collection, d.PrivateID)
+	if err != nil {
+		return errors.Errorf("building upload url: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return errors.Errorf("creating request: %w", err)
+	}
+	if d.Encoding != "" {
+		req.Header.Set("Content-Encoding", d.Encoding)
+	}
+	// a batch that fails again is rejected instead of being stored once more
+	req.Header.Set(resubmitHeader, id)
+	if len(d.Outputs) > 0 {
+		req.Header.Set(outputsHeader, strings.Join(d.Outputs, ","))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Errorf("uploading: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return errors.Errorf("upload failed with %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return dl.Delete(id)
+}
+
+// runScriptCommand runs the script against sample entries and prints what happens to each of them.
+func runScriptCommand(c *types.Config, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return errors.New("usage: loghead script test [-script file] [-collection name] [-private-id id] [sample.json]")
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	file := fs.String("script", c.Loghead.Script.File, "script to run")
+	collection := fs.String("collection", logs.TailnodeCollection, "collection of the sample entries")
+	privateID := fs.String("private-id", "0000000000000000", "private id of the node that uploaded the sample entries")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	// the sample is an upload body, a JSON array of entries
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return errors.Errorf("opening sample: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	reg := prometheus.NewRegistry()
+	sc, err := logs.NewScriptService(types.ScriptConfig{File: *file, Timeout: c.Loghead.Script.Timeout}, reg)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	type result struct {
+		Result string                 `json:"result"`
+		Entry  map[string]interface{} `json:"entry"`
+	}
+	var encErr error
+	write := func(r result) {
+		if err := enc.Encode(r); err != nil {
+			encErr = err
+		}
+	}
+	_, err = decodeEntries(in, func(m map[string]interface{}) {
+		msg := logs.LogtailMsg{
+			Msg:        m,
+			Collection: *collection,
+			PrivateID:  *privateID,
+			ServerTime: time.Now(),
+			Source:     "script test",
+		}
+		keep, derived := sc.Process(msg)
+		if keep {
+			write(result{"keep", msg.Msg})
+		} else {
+			write(result{"drop", msg.Msg})
+		}
+		for _, d := range derived {
+			write(result{"emit", d.Msg})
+		}
+	})
+	if err != nil {
+		return errors.Errorf("reading sample: %w", err)
+	}
+	if encErr != nil {
+		return encErr
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			fmt.Fprintf(os.Stderr, "%s", mf.GetName())
+			for _, lp := range m.GetLabel() {
+				fmt.Fprintf(os.Stderr, " %s=%s", lp.GetName(), lp.GetValue())
+			}
+			fmt.Fprintf(os.Stderr, " %g\n", m.GetCounter().GetValue())
+		}
+	}
+	return nil
+}
+
+func runRecordingsCommand(c *types.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: loghead recordings compress [-min-age duration] | verify | decrypt -identity file [-o file] recording")
+	}
+	switch args[0] {
+	case "compress":
+		fs := flag.NewFlagSet("compress", flag.ContinueOnError)
+		// sessions can last long, a recording that is still written to must not be compressed
+		minAge := fs.Duration("min-age", time.Hour, "only compress recordings that were not modified for this long")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		n, err := ssh.CompressRecordings(c.SSHRecorder.Dir, *minAge)
+		fmt.Printf("Compressed %d recordings\n", n)
+		return err
+	case "verify":
+		rs, err := ssh.NewRecordingService(c.SSHRecorder)
+		if err != nil {
+			return err
+		}
+		report, err := rs.Verify()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATUS\tID\tPATH\tERROR")
+		for _, r := range report.Results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Status, r.ID, r.Path, r.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if !report.OK {
+			return errors.Errorf("verification of %d manifests failed", report.Manifests)
+		}
+		fmt.Printf("Verified %d manifests\n", report.Manifests)
+		return nil
+	case "decrypt":
+		fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+		identity := fs.String("identity", "", "file with the age identities to decrypt the recording with")
+		out := fs.String("o", "", "file to write the decrypted recording to, defaults to stdout")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *identity == "" || fs.NArg() != 1 {
+			return errors.New("usage: loghead recordings decrypt -identity file [-o file] recording")
+		}
+		ids, err := ssh.ReadIdentities(*identity)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return errors.Errorf("opening recording: %w", err)
+		}
+		defer in.Close()
+		if *out == "" {
+			return ssh.DecryptRecording(os.Stdout, in, fs.Arg(0), ids...)
+		}
+		// the decrypted recording is as sensitive as the session
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return errors.Errorf("creating output: %w", err)
+		}
+		return errors.Join(ssh.DecryptRecording(f, in, fs.Arg(0), ids...), f.Close())
+	default:
+		return errors.Errorf("unknown recordings command %s", args[0])
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/logs"
+	"github.com/qup42/loghead/policy"
+	"github.com/qup42/loghead/types"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newDeadLetterPolicy allows clients in cidrs to use the dead letter store.
+func newDeadLetterPolicy(t *testing.T, cidrs ...string) *policy.PolicyService {
+	ps, err := policy.NewPolicyService(types.PolicyConfig{DeadLetter: types.PolicyRuleConfig{Enabled: true, CIDRs: cidrs}}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+func TestResubmitDeadLetter(t *testing.T) {
+	dl := &logs.DeadLetterService{Dir: t.TempDir()}
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{DeadLetter: dl, Policy: newDeadLetterPolicy(t, "127.0.0.0/8")}))
+	if code := postBatch(t, srv, `[{"text": "a"}, {"text"`, nil); code != http.StatusOK {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+	}
+	ds, err := dl.List()
+	if err != nil || len(ds) != 1 {
+		t.Fatalf(`List() = %+v, %s, want 1 dead letter`, ds, err)
+	}
+	id := ds[0].ID
+
+	// the batch still fails, it is neither stored again nor deleted
+	if err := resubmitDeadLetter(dl, srv.URL, id); err == nil {
+		t.Fatal(`resubmitDeadLetter() of a broken batch succeeded`)
+	}
+	if ds, err := dl.List(); err != nil || len(ds) != 1 || ds[0].ID != id {
+		t.Fatalf(`List() = %+v, %s, want only %s`, ds, err, id)
+	}
+
+	// fixed by the operator
+	if err := os.WriteFile(filepath.Join(dl.Dir, id+".body"), []byte(testEntries), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := resubmitDeadLetter(dl, srv.URL, id); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err := dl.List(); err != nil || len(ds) != 0 {
+		t.Fatalf(`List() = %+v, %s, want no dead letters`, ds, err)
+	}
+}
+
+func TestResubmitTarget(t *testing.T) {
+	tests := []struct {
+		c      types.ListenerConfig
+		target string
+	}{
+		{c: types.ListenerConfig{Type: "plain", Port: "5678"}, target: "http://localhost:5678"},
+		{c: types.ListenerConfig{Type: "plain", Addr: "0.0.0.0", Port: "5678"}, target: "http://localhost:5678"},
+		{c: types.ListenerConfig{Type: "plain", Addr: "::", Port: "5678"}, target: "http://localhost:5678"},
+		{c: types.ListenerConfig{Type: "plain", Addr: "10.0.0.1", Port: "5678"}, target: "http://10.0.0.1:5678"},
+		{c: types.ListenerConfig{Type: "plain", Addr: "fd7a:115c:a1e0::1", Port: "5678"}, target: "http://[fd7a:115c:a1e0::1]:5678"},
+		{c: types.ListenerConfig{Type: "tsnet", Port: "5678"}, target: ""},
+	}
+
+	for _, tc := range tests {
+		if target := resubmitTarget(tc.c); target != tc.target {
+			t.Fatalf(`resubmitTarget(%+v) = %q, want %q`, tc.c, target, tc.target)
+		}
+	}
+}
+
+func TestResubmitHeadersIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+		id    func(stored string) string
+	}{
+		{name: "denied by policy", cidrs: []string{"10.0.0.0/8"}, id: func(stored string) string { return stored }},
+		{name: "unknown dead letter", cidrs: []string{"127.0.0.0/8"}, id: func(string) string { return "0123456789abcdef" }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dl := &logs.DeadLetterService{Dir: t.TempDir()}
+			srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{DeadLetter: dl, Policy: newDeadLetterPolicy(t, tc.cidrs...)}))
+			if code := postBatch(t, srv, `[{"text"`, nil); code != http.StatusOK {
+				t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+			}
+			ds, err := dl.List()
+			if err != nil || len(ds) != 1 {
+				t.Fatalf(`List() = %+v, %s, want 1 dead letter`, ds, err)
+			}
+			// the upload is handled like any other, it is stored as another dead letter
+			header := http.Header{resubmitHeader: {tc.id(ds[0].ID)}, outputsHeader: {logs.OutputExternal}}
+			if code := postBatch(t, srv, `[{"text"`, header); code != http.StatusOK {
+				t.Fatalf(`upload with resubmit headers = %d, want %d`, code, http.StatusOK)
+			}
+			if ds, err := dl.List(); err != nil || len(ds) != 2 {
+				t.Fatalf(`List() = %+v, %s, want 2 dead letters`, ds, err)
+			}
+		})
+	}
+}
+
+func TestResubmitPartialDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := logs.NewFileLoggerService(types.FileLoggerConfig{Dir: dir, Format: logs.FormatJSON, Fsync: logs.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := logs.NewSequenceService(prometheus.NewRegistry())
+	ep, err := logs.NewExternalProcessorService(types.ExternalProcessorConfig{Command: []string{"cat"}, Buffer: 1 << 20, Timeout: time.Second}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.Collections = []string{logs.TailnodeCollection}
+	records := make(chan logs.LogtailMsg, 10)
+	ep.Sink = func(msgs []logs.LogtailMsg) {
+		for _, m := range msgs {
+			records <- m
+		}
+	}
+	ep.Start()
+	defer ep.Close()
+	dl := &logs.DeadLetterService{Dir: t.TempDir()}
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{FileLogger: fl, Sequence: ss, External: ep, DeadLetter: dl, Policy: newDeadLetterPolicy(t, "127.0.0.0/8")}))
+
+	// the log file cannot be created
+	p := filepath.Join(dir, logs.TailnodeCollection, "0123abcd")
+	if err := os.MkdirAll(p, 0700); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"logtail": {"proc_id": 1, "proc_seq": 1}, "text": "a"}]`
+	if code := postBatch(t, srv, body, nil); code != http.StatusOK {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+	}
+	ds, err := dl.List()
+	want := []string{logs.OutputFileLogger, logs.OutputExternal}
+	if err != nil || len(ds) != 1 || !reflect.DeepEqual(ds[0].Outputs, want) {
+		t.Fatalf(`List() = %+v, %s, want 1 dead letter for %v`, ds, err, want)
+	}
+
+	// the entry was seen already, it is still written
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := resubmitDeadLetter(dl, srv.URL, ds[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte(`"text":"a"`)); n != 1 {
+		t.Fatalf(`log file contains entry a %d times, want once: %s`, n, b)
+	}
+
+	// the external processor only received the resubmitted batch
+	for i := range 2 {
+		select {
+		case m := <-records:
+			if i > 0 {
+				t.Fatalf(`external processor received %+v twice`, m.Msg)
+			}
+		case <-time.After(time.Second):
+			if i == 0 {
+				t.Fatal(`external processor did not receive the resubmitted batch`)
+			}
+		}
+	}
+}
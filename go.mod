@@ -5,6 +5,7 @@ go 1.24.0
 toolchain go1.24.2
 
 require (
+	filippo.io/age v1.2.1
 	github.com/cockroachdb/errors v1.11.3
 	github.com/efekarakus/termcolor v1.0.1
 	github.com/gorilla/mux v1.8.1
@@ -15,7 +16,9 @@ require (
 	github.com/prometheus/common v0.63.0
 	github.com/rs/zerolog v1.34.0
 	github.com/spf13/viper v1.20.1
+	go.starlark.net v0.0.0-20250417143717-f57e51f710eb
 	golang.org/x/sync v0.13.0
+	golang.org/x/time v0.11.0
 	tailscale.com v1.82.5
 )
 
@@ -68,6 +71,7 @@ require (
 	github.com/kortschak/wol v0.0.0-20200729010619-da482cc4850a // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mdlayher/genetlink v1.3.2 // indirect
@@ -112,7 +116,6 @@ require (
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/term v0.31.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
-	golang.org/x/time v0.11.0 // indirect
 	golang.org/x/tools v0.32.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
 	golang.zx2c4.com/wireguard/windows v0.5.3 // indirect
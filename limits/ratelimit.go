@@ -0,0 +1,140 @@
+package limits
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+// idle per node limiters are forgotten after this time
+const nodeLimiterTTL = 10 * time.Minute
+
+type nodeLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimitService limits the rate of uploads per node and in total
+// and the number of requests that are processed concurrently.
+type RateLimitService struct {
+	perNode      rate.Limit
+	perNodeBurst int
+	global       *rate.Limiter
+	inFlight     chan struct{}
+
+	mu          sync.Mutex
+	nodes       map[string]*nodeLimiter
+	lastCleanup time.Time
+
+	Throttled *prometheus.CounterVec
+}
+
+func NewRateLimitService(c types.LimitsConfig, reg prometheus.Registerer) *RateLimitService {
+	rl := &RateLimitService{
+		perNode:      rate.Limit(c.PerNodeRate),
+		perNodeBurst: c.PerNodeBurst,
+		nodes:        map[string]*nodeLimiter{},
+		lastCleanup:  time.Now(),
+		Throttled: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_throttled_requests_total",
+				Help: "Number of requests rejected because a rate or concurrency limit was exceeded.",
+			},
+			[]string{"limit"}),
+	}
+	if c.GlobalRate > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(c.GlobalRate), c.GlobalBurst)
+	}
+	if c.MaxInFlight > 0 {
+		rl.inFlight = make(chan struct{}, c.MaxInFlight)
+	}
+	reg.MustRegister(rl.Throttled)
+	return rl
+}
+
+func (rl *RateLimitService) nodeLimiter(privateID string, now time.Time) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastCleanup) > nodeLimiterTTL {
+		for id, nl := range rl.nodes {
+			if now.Sub(nl.lastSeen) > nodeLimiterTTL {
+				delete(rl.nodes, id)
+			}
+		}
+		rl.lastCleanup = now
+	}
+
+	nl, ok := rl.nodes[privateID]
+	if !ok {
+		nl = &nodeLimiter{limiter: rate.NewLimiter(rl.perNode, rl.perNodeBurst)}
+		rl.nodes[privateID] = nl
+	}
+	nl.lastSeen = now
+	return nl.limiter
+}
+
+// reserve takes a token from l. If no token is available now,
+// nothing is taken and the time until one is available is returned.
+func reserve(l *rate.Limiter, now time.Time) (*rate.Reservation, time.Duration) {
+	r := l.ReserveN(now, 1)
+	if !r.OK() {
+		// burst is 0, requests can never succeed
+		return nil, time.Second
+	}
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return nil, d
+	}
+	return r, 0
+}
+
+// Allow reports whether an upload of the node may be processed now.
+// If not, it also returns after how long the node should retry.
+func (rl *RateLimitService) Allow(privateID string) (bool, time.Duration) {
+	now := time.Now()
+	var nr *rate.Reservation
+	if rl.perNode > 0 {
+		var d time.Duration
+		nr, d = reserve(rl.nodeLimiter(privateID, now), now)
+		if nr == nil {
+			rl.Throttled.With(prometheus.Labels{"limit": "node"}).Inc()
+			return false, d
+		}
+	}
+	if rl.global != nil {
+		if gr, d := reserve(rl.global, now); gr == nil {
+			// the upload is not processed, so it should not count towards the node's limit
+			if nr != nil {
+				nr.CancelAt(now)
+			}
+			rl.Throttled.With(prometheus.Labels{"limit": "global"}).Inc()
+			return false, d
+		}
+	}
+	return true, 0
+}
+
+// Acquire reserves a slot for processing a request. It returns false if too many requests are in flight.
+// Every successful Acquire must be followed by a Release.
+func (rl *RateLimitService) Acquire() bool {
+	if rl.inFlight == nil {
+		return true
+	}
+	select {
+	case rl.inFlight <- struct{}{}:
+		return true
+	default:
+		rl.Throttled.With(prometheus.Labels{"limit": "in_flight"}).Inc()
+		return false
+	}
+}
+
+func (rl *RateLimitService) Release() {
+	if rl.inFlight == nil {
+		return
+	}
+	<-rl.inFlight
+}
@@ -0,0 +1,51 @@
+package limits
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"testing"
+)
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name   string
+		config types.LimitsConfig
+		nodes  []string
+		out    []bool
+	}{
+		{name: "unlimited", config: types.LimitsConfig{}, nodes: []string{"a", "a", "a"}, out: []bool{true, true, true}},
+		{name: "per node", config: types.LimitsConfig{PerNodeRate: 0.001, PerNodeBurst: 2}, nodes: []string{"a", "a", "b", "a", "b"}, out: []bool{true, true, true, false, true}},
+		{name: "global", config: types.LimitsConfig{GlobalRate: 0.001, GlobalBurst: 2}, nodes: []string{"a", "b", "c"}, out: []bool{true, true, false}},
+		{name: "node throttled before global", config: types.LimitsConfig{PerNodeRate: 0.001, PerNodeBurst: 1, GlobalRate: 0.001, GlobalBurst: 2}, nodes: []string{"a", "a", "b", "c"}, out: []bool{true, false, true, false}},
+		{name: "global throttled refunds node", config: types.LimitsConfig{PerNodeRate: 0.001, PerNodeBurst: 2, GlobalRate: 0.001, GlobalBurst: 1}, nodes: []string{"a", "b", "b"}, out: []bool{true, false, false}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := NewRateLimitService(tc.config, prometheus.NewRegistry())
+			for i, n := range tc.nodes {
+				ok, retryAfter := rl.Allow(n)
+				if ok != tc.out[i] {
+					t.Fatalf(`Allow("%s") #%d = %t, want %t`, n, i, ok, tc.out[i])
+				}
+				if !ok && retryAfter <= 0 {
+					t.Fatalf(`Allow("%s") #%d retry after %s, want > 0`, n, i, retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	rl := NewRateLimitService(types.LimitsConfig{MaxInFlight: 2}, prometheus.NewRegistry())
+	if !rl.Acquire() || !rl.Acquire() {
+		t.Fatalf("Acquire() = false, want true")
+	}
+	if rl.Acquire() {
+		t.Fatalf("Acquire() = true with all slots in use, want false")
+	}
+	rl.Release()
+	if !rl.Acquire() {
+		t.Fatalf("Acquire() after Release() = false, want true")
+	}
+}
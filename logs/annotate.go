@@ -0,0 +1,47 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// AnnotationService stamps server side information onto each entry,
+// similar to what the logtail server does.
+type AnnotationService struct {
+	ClockSkew *prometheus.GaugeVec
+}
+
+func NewAnnotationService(reg prometheus.Registerer) *AnnotationService {
+	as := &AnnotationService{
+		ClockSkew: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loghead_logtail_clock_skew_seconds",
+				Help: "Difference between the server receive time and the client time of the last log entry. Positive values mean the client's clock is behind.",
+			},
+			[]string{"private_id"}),
+	}
+	reg.MustRegister(as.ClockSkew)
+	return as
+}
+
+// Process adds `server_time`, `source` and `collection` to the entry's `logtail` field.
+func (as *AnnotationService) Process(msg LogtailMsg) {
+	meta, ok, err := msg.Meta()
+	if err != nil {
+		log.Warn().Err(err).Str("private_id", msg.PrivateID).Msg("Invalid logtail metadata")
+	}
+	if ok && !meta.ClientTime.IsZero() {
+		skew := msg.ServerTime.Sub(meta.ClientTime)
+		as.ClockSkew.With(prometheus.Labels{"private_id": msg.PrivateID}).Set(skew.Seconds())
+	}
+
+	lt, ok := msg.Msg["logtail"].(map[string]interface{})
+	if !ok {
+		lt = map[string]interface{}{}
+		msg.Msg["logtail"] = lt
+	}
+	lt["server_time"] = msg.ServerTime.UTC().Format(time.RFC3339Nano)
+	lt["source"] = msg.Source
+	lt["collection"] = msg.Collection
+}
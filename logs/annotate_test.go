@@ -0,0 +1,81 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnnotateFields(t *testing.T) {
+	serverTime := time.Date(2024, 12, 21, 13, 0, 0, 500, time.FixedZone("", 60*60))
+	want := map[string]interface{}{
+		"server_time": "2024-12-21T12:00:00.0000005Z",
+		"source":      "host.tail-scale.ts.net",
+		"collection":  TailnodeCollection,
+	}
+	tests := []struct {
+		name string
+		msg  map[string]interface{}
+		out  map[string]interface{}
+	}{
+		{name: "no logtail", msg: map[string]interface{}{"text": "a"}, out: want},
+		{
+			name: "logtail",
+			msg:  map[string]interface{}{"text": "a", "logtail": map[string]interface{}{"proc_id": float64(1)}},
+			out:  map[string]interface{}{"proc_id": float64(1), "server_time": want["server_time"], "source": want["source"], "collection": want["collection"]},
+		},
+		{
+			name: "overwrites client values",
+			msg:  map[string]interface{}{"text": "a", "logtail": map[string]interface{}{"server_time": "2000-01-01T00:00:00Z", "source": "spoofed"}},
+			out:  want,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			as := NewAnnotationService(prometheus.NewRegistry())
+			as.Process(LogtailMsg{Msg: tc.msg, Collection: TailnodeCollection, PrivateID: "abc", ServerTime: serverTime, Source: "host.tail-scale.ts.net"})
+			if out := tc.msg["logtail"]; !reflect.DeepEqual(out, tc.out) {
+				t.Fatalf(`logtail = %v, want %v`, out, tc.out)
+			}
+			if text := tc.msg["text"]; text != "a" {
+				t.Fatalf(`text = %v, want a`, text)
+			}
+		})
+	}
+}
+
+func TestAnnotateClockSkew(t *testing.T) {
+	serverTime := time.Date(2024, 12, 21, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		logtail map[string]interface{}
+		skew    float64
+		set     bool
+	}{
+		{name: "client behind", logtail: map[string]interface{}{"client_time": "2024-12-21T11:59:58.5Z"}, skew: 1.5, set: true},
+		{name: "client ahead", logtail: map[string]interface{}{"client_time": "2024-12-21T12:00:03Z"}, skew: -3, set: true},
+		{name: "in sync", logtail: map[string]interface{}{"client_time": "2024-12-21T12:00:00Z"}, skew: 0, set: true},
+		{name: "missing client_time", logtail: map[string]interface{}{"proc_id": float64(1)}},
+		{name: "invalid client_time", logtail: map[string]interface{}{"client_time": "yesterday"}},
+		{name: "client_time not a string", logtail: map[string]interface{}{"client_time": float64(1734782400)}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			as := NewAnnotationService(prometheus.NewRegistry())
+			as.Process(LogtailMsg{Msg: map[string]interface{}{"logtail": tc.logtail}, Collection: TailnodeCollection, PrivateID: "abc", ServerTime: serverTime})
+			if n := testutil.CollectAndCount(as.ClockSkew); (n == 1) != tc.set {
+				t.Fatalf(`%d clock skew series, want set = %t`, n, tc.set)
+			}
+			if !tc.set {
+				return
+			}
+			if skew := testutil.ToFloat64(as.ClockSkew.WithLabelValues("abc")); skew != tc.skew {
+				t.Fatalf(`clock skew = %f, want %f`, skew, tc.skew)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package logs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"github.com/qup42/loghead/types"
+	"github.com/qup42/loghead/util"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DeadLetter describes a batch of client logs that could not be processed.
+type DeadLetter struct {
+	ID         string    `json:"id"`
+	Collection string    `json:"collection"`
+	PrivateID  string    `json:"private_id"`
+	Source     string    `json:"source"`
+	Encoding   string    `json:"encoding,omitempty"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+	Size       int       `json:"size"`
+	// Outputs that still have to process the batch, the other outputs processed it already.
+	// Empty if the batch was rejected before it was processed.
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// outputs that can be left to process a batch
+const (
+	OutputFileLogger = "filelogger"
+	OutputExternal   = "external"
+)
+
+// DeadLetterService stores rejected batches as received so that they can be resubmitted later.
+// Each batch is stored as `<id>.body` and its metadata as `<id>.json`.
+type DeadLetterService struct {
+	Dir string
+}
+
+var deadLetterID = regexp.MustCompile(`^[0-9TZ.]+-[0-9a-f]+$`)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+func NewDeadLetterService(c types.DeadLetterConfig) (*DeadLetterService, error) {
+	err := util.EnsureFolderExists(c.Dir)
+	if err != nil {
+		return nil, errors.Errorf("init DeadLetter: %w", err)
+	}
+	return &DeadLetterService{c.Dir}, nil
+}
+
+func newDeadLetterID(t time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(b), nil
+}
+
+func (dl *DeadLetterService) paths(id string) (string, string, error) {
+	if !deadLetterID.MatchString(id) {
+		return "", "", ErrDeadLetterNotFound
+	}
+	base := filepath.Join(dl.Dir, id)
+	return base + ".json", base + ".body", nil
+}
+
+// Store saves the batch and its metadata. The ID, time and size of d are filled in.
+func (dl *DeadLetterService) Store(d DeadLetter, body []byte) (*DeadLetter, error) {
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+	id, err := newDeadLetterID(d.Time)
+	if err != nil {
+		return nil, errors.Errorf("generating dead letter id: %w", err)
+	}
+	d.ID = id
+	d.Size = len(body)
+	metaP, bodyP, err := dl.paths(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(bodyP, body, 0600); err != nil {
+		return nil, errors.Errorf("writing %s: %w", bodyP, err)
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, errors.Errorf("marshaling dead letter: %w", err)
+	}
+	// the metadata is written last, a dead letter without metadata is not listed
+	if err := os.WriteFile(metaP, b, 0600); err != nil {
+		return nil, errors.Errorf("writing %s: %w", metaP, err)
+	}
+	return &d, nil
+}
+
+func (dl *DeadLetterService) Get(id string) (*DeadLetter, error) {
+	metaP, _, err := dl.paths(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(metaP)
+	if os.IsNotExist(err) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", metaP, err)
+	}
+	var d DeadLetter
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Errorf("unmarshaling %s: %w", metaP, err)
+	}
+	return &d, nil
+}
+
+func (dl *DeadLetterService) Body(id string) ([]byte, error) {
+	_, bodyP, err := dl.paths(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(bodyP)
+	if os.IsNotExist(err) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", bodyP, err)
+	}
+	return b, nil
+}
+
+// List returns all dead letters, oldest first.
+func (dl *DeadLetterService) List() ([]DeadLetter, error) {
+	entries, err := os.ReadDir(dl.Dir)
+	if err != nil {
+		return nil, errors.Errorf("listing %s: %w", dl.Dir, err)
+	}
+	ds := []DeadLetter{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		d, err := dl.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, *d)
+	}
+	slices.SortFunc(ds, func(a, b DeadLetter) int {
+		return a.Time.Compare(b.Time)
+	})
+	return ds, nil
+}
+
+func (dl *DeadLetterService) Delete(id string) error {
+	metaP, bodyP, err := dl.paths(id)
+	if err != nil {
+		return err
+	}
+	errMeta := os.Remove(metaP)
+	if os.IsNotExist(errMeta) {
+		return ErrDeadLetterNotFound
+	}
+	errBody := os.Remove(bodyP)
+	return errors.Join(errMeta, errBody)
+}
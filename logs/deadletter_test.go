@@ -0,0 +1,46 @@
+package logs
+
+import (
+	"github.com/cockroachdb/errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dl := &DeadLetterService{t.TempDir()}
+	body := []byte(`[{"text": "a"`)
+	stored, err := dl.Store(DeadLetter{
+		Collection: TailnodeCollection,
+		PrivateID:  "abc",
+		Error:      "unexpected EOF",
+		Time:       time.Date(2024, 12, 22, 12, 0, 0, 0, time.UTC),
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := dl.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || !reflect.DeepEqual(ds[0], *stored) {
+		t.Fatalf(`List() = %+v, want [%+v]`, ds, *stored)
+	}
+	b, err := dl.Body(stored.ID)
+	if err != nil || string(b) != string(body) {
+		t.Fatalf(`Body("%s") = "%s", %v, want "%s"`, stored.ID, b, err, body)
+	}
+
+	if err := dl.Delete(stored.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dl.Get(stored.ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf(`Get("%s") after Delete = %v, want %v`, stored.ID, err, ErrDeadLetterNotFound)
+	}
+	for _, id := range []string{"../config", "", "a/b"} {
+		if _, err := dl.Body(id); !errors.Is(err, ErrDeadLetterNotFound) {
+			t.Fatalf(`Body("%s") = %v, want %v`, id, err, ErrDeadLetterNotFound)
+		}
+	}
+}
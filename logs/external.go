@@ -0,0 +1,348 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maximum number of records that are passed to the sink at once
+const externalSinkBatchSize = 512
+
+// externalRecord is a line of the external processor protocol.
+// Entries are written to the processor's stdin in this format, and the processor writes records in the same format to stdout.
+type externalRecord struct {
+	Collection string                 `json:"collection"`
+	PrivateID  string                 `json:"private_id"`
+	ServerTime time.Time              `json:"server_time"`
+	Source     string                 `json:"source,omitempty"`
+	Node       string                 `json:"node,omitempty"`
+	Entry      map[string]interface{} `json:"entry"`
+}
+
+// ExternalProcessorService streams the entries to an executable as NDJSON and passes the records it writes back to Sink.
+// The executable is restarted with a backoff if it exits.
+// Entries are buffered up to MaxBuffer bytes, uploads that do not fit are dropped so that a stuck processor does not block ingestion.
+type ExternalProcessorService struct {
+	Command []string
+	// Replace the entries with the records of the processor in the filelogger
+	Replace    bool
+	MaxBuffer  int64
+	Timeout    time.Duration
+	MaxBackoff time.Duration
+	// Sink receives the records of the processor
+	Sink func([]LogtailMsg)
+	// Collections the records may belong to, records of other collections are dropped
+	Collections []string
+
+	Dropped  *prometheus.CounterVec
+	Restarts prometheus.Counter
+	Records  prometheus.Counter
+
+	mu     sync.Mutex
+	queue  [][]byte
+	queued int64
+	notify chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewExternalProcessorService(c types.ExternalProcessorConfig, reg prometheus.Registerer) (*ExternalProcessorService, error) {
+	if len(c.Command) == 0 {
+		return nil, errors.New("external processor command is empty")
+	}
+	if _, err := exec.LookPath(c.Command[0]); err != nil {
+		return nil, errors.Errorf("external processor: %w", err)
+	}
+	// an unbounded buffer would let a stuck processor exhaust the memory
+	if c.Buffer <= 0 {
+		return nil, errors.Errorf("external processor buffer must be positive, got %d", c.Buffer)
+	}
+	ep := &ExternalProcessorService{
+		Command:    c.Command,
+		Replace:    c.Replace,
+		MaxBuffer:  c.Buffer,
+		Timeout:    c.Timeout,
+		MaxBackoff: c.MaxBackoff,
+		Dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_external_dropped_entries_total",
+				Help: "Number of log entries that were not processed by the external processor, by reason (buffer_full, write_failed or collection).",
+			},
+			[]string{"reason"}),
+		Restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "loghead_external_restarts_total",
+			Help: "Number of times the external processor was restarted.",
+		}),
+		Records: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "loghead_external_records_total",
+			Help: "Number of records returned by the external processor.",
+		}),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if ep.MaxBackoff < time.Second {
+		ep.MaxBackoff = time.Second
+	}
+	reg.MustRegister(ep.Dropped, ep.Restarts, ep.Records)
+	return ep, nil
+}
+
+// Start runs and supervises the processor until Close is called.
+func (ep *ExternalProcessorService) Start() {
+	ep.wg.Add(1)
+	go func() {
+		defer ep.wg.Done()
+		ep.supervise()
+	}()
+}
+
+// Close stops the processor. Buffered entries are discarded.
+func (ep *ExternalProcessorService) Close() {
+	close(ep.done)
+	ep.wg.Wait()
+}
+
+// ExternalBatch holds the encoded entries of an upload until it is enqueued.
+type ExternalBatch struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+	n   int
+}
+
+func (ep *ExternalProcessorService) NewBatch() *ExternalBatch {
+	b := &ExternalBatch{}
+	b.enc = json.NewEncoder(&b.buf)
+	return b
+}
+
+// Add encodes the entry, the message is not used afterward.
+func (b *ExternalBatch) Add(m LogtailMsg) {
+	r := externalRecord{
+		Collection: m.Collection,
+		PrivateID:  m.PrivateID,
+		ServerTime: m.ServerTime,
+		Source:     m.Source,
+		Entry:      m.Msg,
+	}
+	if m.Peer != nil {
+		r.Node = m.Peer.NodeName
+	}
+	if err := b.enc.Encode(r); err != nil {
+		log.Warn().Err(err).Str("private_id", m.PrivateID).Msg("Could not encode entry for the external processor")
+		return
+	}
+	b.n++
+}
+
+// Enqueue buffers an upload for the processor.
+func (ep *ExternalProcessorService) Enqueue(msgs []LogtailMsg) {
+	b := ep.NewBatch()
+	for _, m := range msgs {
+		b.Add(m)
+	}
+	ep.EnqueueBatch(b)
+}
+
+// EnqueueBatch buffers the encoded entries of an upload for the processor.
+func (ep *ExternalProcessorService) EnqueueBatch(b *ExternalBatch) {
+	if b.n == 0 {
+		return
+	}
+	ep.mu.Lock()
+	if ep.queued+int64(b.buf.Len()) > ep.MaxBuffer {
+		ep.mu.Unlock()
+		ep.Dropped.With(prometheus.Labels{"reason": "buffer_full"}).Add(float64(b.n))
+		return
+	}
+	ep.queue = append(ep.queue, b.buf.Bytes())
+	ep.queued += int64(b.buf.Len())
+	ep.mu.Unlock()
+	select {
+	case ep.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns all buffered batches.
+func (ep *ExternalProcessorService) dequeue() [][]byte {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	q := ep.queue
+	ep.queue = nil
+	ep.queued = 0
+	return q
+}
+
+func (ep *ExternalProcessorService) supervise() {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := ep.run()
+		select {
+		case <-ep.done:
+			return
+		default:
+		}
+		// the processor ran long enough to be considered healthy
+		if time.Since(started) > ep.MaxBackoff {
+			backoff = time.Second
+		}
+		log.Error().Err(err).Msgf("External processor exited, restarting in %s", backoff)
+		select {
+		case <-ep.done:
+			return
+		case <-time.After(backoff):
+		}
+		ep.Restarts.Inc()
+		backoff = min(2*backoff, ep.MaxBackoff)
+	}
+}
+
+// run starts the processor and feeds it until it exits, a write times out or Close is called.
+func (ep *ExternalProcessorService) run() error {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return errors.Errorf("creating stdin pipe: %w", err)
+	}
+	defer stdinW.Close()
+	cmd := exec.Command(ep.Command[0], ep.Command[1:]...)
+	cmd.Stdin = stdinR
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdinR.Close()
+		return errors.Errorf("creating stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdinR.Close()
+		return errors.Errorf("creating stderr pipe: %w", err)
+	}
+	err = cmd.Start()
+	stdinR.Close()
+	if err != nil {
+		return errors.Errorf("starting: %w", err)
+	}
+	pid := cmd.Process.Pid
+	log.Info().Int("pid", pid).Msgf("Started external processor %s", ep.Command[0])
+
+	// the pipes have to be read before Wait is called
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		ep.readRecords(stdout)
+	}()
+	go func() {
+		defer readers.Done()
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			log.Warn().Int("pid", pid).Msg(s.Text())
+		}
+	}()
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		readers.Wait()
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	err = ep.feed(stdinW, exited)
+	// stop the processor if it is still running
+	_ = cmd.Process.Kill()
+	stdinW.Close()
+	<-exited
+	if err != nil {
+		return err
+	}
+	if waitErr != nil {
+		return errors.Errorf("exited: %w", waitErr)
+	}
+	return errors.New("exited")
+}
+
+// feed writes the buffered batches to the processor until it exits or Close is called.
+func (ep *ExternalProcessorService) feed(w *os.File, exited <-chan struct{}) error {
+	for {
+		select {
+		case <-ep.done:
+			return nil
+		case <-exited:
+			return nil
+		case <-ep.notify:
+		}
+		q := ep.dequeue()
+		for i, b := range q {
+			if ep.Timeout > 0 {
+				if err := w.SetWriteDeadline(time.Now().Add(ep.Timeout)); err != nil {
+					return errors.Errorf("setting write deadline: %w", err)
+				}
+			}
+			if _, err := w.Write(b); err != nil {
+				// the rest of the batches are lost as well
+				lost := 0
+				for _, b := range q[i:] {
+					lost += bytes.Count(b, []byte{'\n'})
+				}
+				ep.Dropped.With(prometheus.Labels{"reason": "write_failed"}).Add(float64(lost))
+				return errors.Errorf("writing entries: %w", err)
+			}
+		}
+	}
+}
+
+// readRecords passes the records the processor writes to the sink.
+// Records are collected while more output is buffered, so that they reach the sink in batches.
+func (ep *ExternalProcessorService) readRecords(r io.Reader) {
+	br := bufio.NewReader(r)
+	var batch []LogtailMsg
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec externalRecord
+			if jerr := json.Unmarshal(line, &rec); jerr != nil || rec.Collection == "" || rec.PrivateID == "" || rec.Entry == nil {
+				log.Warn().Err(jerr).Msg("External processor wrote an invalid record")
+			} else if !slices.Contains(ep.Collections, rec.Collection) {
+				log.Warn().Msgf("External processor wrote a record for collection %s that is not accepted", rec.Collection)
+				ep.Dropped.With(prometheus.Labels{"reason": "collection"}).Inc()
+			} else {
+				m := LogtailMsg{
+					Msg:        rec.Entry,
+					Collection: rec.Collection,
+					PrivateID:  rec.PrivateID,
+					ServerTime: rec.ServerTime,
+					Source:     rec.Source,
+				}
+				if m.ServerTime.IsZero() {
+					m.ServerTime = time.Now()
+				}
+				if rec.Node != "" {
+					m.Peer = &types.PeerIdentity{NodeName: rec.Node}
+				}
+				batch = append(batch, m)
+			}
+		}
+		if len(batch) > 0 && (err != nil || br.Buffered() == 0 || len(batch) >= externalSinkBatchSize) {
+			ep.Records.Add(float64(len(batch)))
+			if ep.Sink != nil {
+				ep.Sink(batch)
+			}
+			batch = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/qup42/loghead/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestExternalProcessor(t *testing.T, c types.ExternalProcessorConfig) (*ExternalProcessorService, chan LogtailMsg) {
+	if c.Buffer == 0 {
+		c.Buffer = 1 << 20
+	}
+	ep, err := NewExternalProcessorService(c, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.Collections = []string{TailnodeCollection}
+	records := make(chan LogtailMsg, 100)
+	ep.Sink = func(msgs []LogtailMsg) {
+		for _, m := range msgs {
+			records <- m
+		}
+	}
+	return ep, records
+}
+
+func receive(t *testing.T, records chan LogtailMsg) LogtailMsg {
+	select {
+	case m := <-records:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record from the external processor")
+		return LogtailMsg{}
+	}
+}
+
+func TestExternalProcessor(t *testing.T) {
+	// cat returns the entries unchanged
+	ep, records := newTestExternalProcessor(t, types.ExternalProcessorConfig{Command: []string{"cat"}, Timeout: time.Second})
+	ep.Start()
+	defer ep.Close()
+
+	ep.Enqueue([]LogtailMsg{
+		{Msg: map[string]interface{}{"text": "a"}, Collection: TailnodeCollection, PrivateID: "abc", Peer: &types.PeerIdentity{NodeName: "node1"}},
+		{Msg: map[string]interface{}{"text": "b"}, Collection: TailnodeCollection, PrivateID: "abc"},
+	})
+	for _, text := range []string{"a", "b"} {
+		m := receive(t, records)
+		if m.Msg["text"] != text || m.Collection != TailnodeCollection || m.PrivateID != "abc" {
+			t.Fatalf(`record = %+v, want text %s`, m, text)
+		}
+	}
+}
+
+func TestExternalProcessorCollections(t *testing.T) {
+	ep, records := newTestExternalProcessor(t, types.ExternalProcessorConfig{Command: []string{"cat"}, Timeout: time.Second})
+	ep.Start()
+	defer ep.Close()
+
+	ep.Enqueue([]LogtailMsg{
+		{Msg: map[string]interface{}{"text": "a"}, Collection: "other.log.tailscale.io", PrivateID: "abc"},
+		{Msg: map[string]interface{}{"text": "b"}, Collection: TailnodeCollection, PrivateID: "abc"},
+	})
+	if m := receive(t, records); m.Msg["text"] != "b" {
+		t.Fatalf(`record = %+v, want text b`, m)
+	}
+	if dropped := testutil.ToFloat64(ep.Dropped.WithLabelValues("collection")); dropped != 1 {
+		t.Fatalf(`dropped = %f, want 1`, dropped)
+	}
+}
+
+func TestExternalProcessorRestart(t *testing.T) {
+	// the processor exits after each entry
+	ep, records := newTestExternalProcessor(t, types.ExternalProcessorConfig{Command: []string{"head", "-n", "1"}, Timeout: time.Second})
+	ep.Start()
+	defer ep.Close()
+
+	for _, text := range []string{"a", "b"} {
+		ep.Enqueue([]LogtailMsg{{Msg: map[string]interface{}{"text": text}, Collection: TailnodeCollection, PrivateID: "abc"}})
+		if m := receive(t, records); m.Msg["text"] != text {
+			t.Fatalf(`record = %+v, want text %s`, m, text)
+		}
+		// wait for the restart
+		for text == "a" && testutil.ToFloat64(ep.Restarts) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestExternalProcessorInvalidBuffer(t *testing.T) {
+	for _, buffer := range []int64{0, -1} {
+		if _, err := NewExternalProcessorService(types.ExternalProcessorConfig{Command: []string{"cat"}, Buffer: buffer}, prometheus.NewRegistry()); err == nil {
+			t.Fatalf(`NewExternalProcessorService() with buffer %d succeeded, want error`, buffer)
+		}
+	}
+}
+
+func TestExternalProcessorBufferFull(t *testing.T) {
+	// not started, nothing is read from the buffer
+	ep, _ := newTestExternalProcessor(t, types.ExternalProcessorConfig{Command: []string{"cat"}, Buffer: 150})
+	for range 3 {
+		ep.Enqueue([]LogtailMsg{{Msg: map[string]interface{}{"text": "a"}, Collection: TailnodeCollection, PrivateID: "abc"}})
+	}
+	if dropped := testutil.ToFloat64(ep.Dropped.WithLabelValues("buffer_full")); dropped != 2 {
+		t.Fatalf(`dropped = %f, want 2`, dropped)
+	}
+}
+
+func TestExternalProcessorTimeout(t *testing.T) {
+	// the processor does not read its input
+	ep, _ := newTestExternalProcessor(t, types.ExternalProcessorConfig{Command: []string{"sleep", "60"}, Timeout: 100 * time.Millisecond})
+	ep.Start()
+	defer ep.Close()
+
+	// larger than the pipe buffer
+	msgs := make([]LogtailMsg, 2000)
+	for i := range msgs {
+		msgs[i] = LogtailMsg{Msg: map[string]interface{}{"text": strings.Repeat("a", 100)}, Collection: TailnodeCollection, PrivateID: "abc"}
+	}
+	ep.Enqueue(msgs)
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(ep.Dropped.WithLabelValues("write_failed")) != 2000 {
+		if time.Now().After(deadline) {
+			t.Fatal("write to the stuck processor did not time out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,47 +1,421 @@
 package logs
 
 import (
-	"encoding/json"
+	"bufio"
+	"container/list"
 	"github.com/cockroachdb/errors"
 	"github.com/qup42/loghead/types"
 	"github.com/qup42/loghead/util"
+	"github.com/rs/zerolog/log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
+const (
+	// FsyncNever leaves it to the OS when the logs are written to disk
+	FsyncNever = "never"
+	// FsyncBatch syncs the file after each batch
+	FsyncBatch = "batch"
+	// FsyncInterval syncs all files that were written to periodically
+	FsyncInterval = "interval"
+)
+
+// logFile is an open log file. Writes to the file are serialized by mu.
+type logFile struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	w     *bufio.Writer
+	dirty bool // written but not synced
+
+	// guarded by FileLoggerService.mu
+	refs     int
+	lastUsed time.Time
+	elem     *list.Element
+	// the writer failed, the file is closed when it is released
+	failed bool
+}
+
+func (lf *logFile) sync() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if !lf.dirty {
+		return nil
+	}
+	lf.dirty = false
+	return lf.f.Sync()
+}
+
+func (lf *logFile) close(fsync bool) error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	err := lf.w.Flush()
+	if fsync && lf.dirty {
+		err = errors.Join(err, lf.f.Sync())
+	}
+	return errors.Join(err, lf.f.Close())
+}
+
+// FileLoggerService writes the logs to one file per node.
+// The files are kept open in an LRU cache and closed when they were not used for a while.
 type FileLoggerService struct {
 	BaseDir string
+	Layout  Layout
+	Format  string
+	// Redactor is applied to the entries before they are written, if set
+	Redactor      *Redactor
+	Fsync         string
+	FsyncInterval time.Duration
+	MaxOpenFiles  int
+	IdleTimeout   time.Duration
+
+	// collection directories that are known to exist
+	created sync.Map
+
+	mu    sync.Mutex
+	files map[string]*logFile
+	// most recently used first
+	lru *list.List
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func NewFileLoggerService(c types.FileLoggerConfig) (*FileLoggerService, error) {
-	err := util.EnsureFolderExists(filepath.Join(c.Dir, TailnodeCollection))
+	err := util.EnsureFolderExists(c.Dir)
 	if err != nil {
 		return nil, errors.Errorf("init FileLogger: %w", err)
 	}
-	err = util.EnsureFolderExists(filepath.Join(c.Dir, TailtrafficCollection))
+	switch c.Fsync {
+	case FsyncNever, FsyncBatch, FsyncInterval:
+	default:
+		return nil, errors.Errorf("init FileLogger: unknown fsync policy %s", c.Fsync)
+	}
+	switch c.Format {
+	case FormatJSON, FormatText:
+	default:
+		return nil, errors.Errorf("init FileLogger: unknown format %s", c.Format)
+	}
+	layout, err := NewLayout(c.Layout)
 	if err != nil {
 		return nil, errors.Errorf("init FileLogger: %w", err)
 	}
-	return &FileLoggerService{c.Dir}, nil
+	fl := &FileLoggerService{
+		BaseDir:       c.Dir,
+		Layout:        layout,
+		Format:        c.Format,
+		Fsync:         c.Fsync,
+		FsyncInterval: c.FsyncInterval,
+		MaxOpenFiles:  max(c.MaxOpenFiles, 1),
+		IdleTimeout:   c.IdleTimeout,
+		files:         map[string]*logFile{},
+		lru:           list.New(),
+		done:          make(chan struct{}),
+	}
+	if fl.IdleTimeout > 0 {
+		fl.wg.Add(1)
+		go fl.run(fl.IdleTimeout/2, fl.closeIdle)
+	}
+	if fl.Fsync == FsyncInterval && fl.FsyncInterval > 0 {
+		fl.wg.Add(1)
+		go fl.run(fl.FsyncInterval, fl.syncAll)
+	}
+	return fl, nil
 }
 
-func (fl *FileLoggerService) Log(m LogtailMsg) error {
-	p := filepath.Join(fl.BaseDir, m.Collection, m.PrivateID)
+func (fl *FileLoggerService) run(interval time.Duration, fn func()) {
+	defer fl.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-fl.done:
+			return
+		case <-t.C:
+			fn()
+		}
+	}
+}
+
+// path returns the file of the message according to the layout. Its directory is created if necessary.
+func (fl *FileLoggerService) path(m LogtailMsg) (string, error) {
+	p, err := fl.resolve(fl.Layout.key(m))
+	if err != nil {
+		return "", err
+	}
+	return p, fl.ensureDir(p)
+}
+
+func (fl *FileLoggerService) resolve(k layoutKey) (string, error) {
+	p, err := util.SafeJoin(fl.BaseDir, fl.Layout.path(k)...)
+	if err != nil {
+		return "", errors.Errorf("resolving log file: %w", err)
+	}
+	return p, nil
+}
+
+func (fl *FileLoggerService) ensureDir(p string) error {
+	dir := filepath.Dir(p)
+	if _, ok := fl.created.Load(dir); !ok {
+		if err := util.EnsureFolderExists(dir); err != nil {
+			return errors.Errorf("creating %s: %w", dir, err)
+		}
+		fl.created.Store(dir, struct{}{})
+	}
+	return nil
+}
+
+// acquire returns the open file for p. It must be released after use.
+func (fl *FileLoggerService) acquire(p string) (*logFile, error) {
+	fl.mu.Lock()
+	if lf, ok := fl.files[p]; ok {
+		fl.useLocked(lf)
+		fl.mu.Unlock()
+		return lf, nil
+	}
+	fl.mu.Unlock()
+
+	// don't block other files while opening
 	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return errors.Errorf("opening %s: %w", p, err)
+		return nil, errors.Errorf("opening %s: %w", p, err)
 	}
 
-	b, _ := json.Marshal(m.Msg)
-	if _, err := f.Write(b); err != nil {
+	fl.mu.Lock()
+	if lf, ok := fl.files[p]; ok {
+		// opened concurrently
+		fl.useLocked(lf)
+		fl.mu.Unlock()
+		_ = f.Close()
+		return lf, nil
+	}
+	lf := &logFile{path: p, f: f, w: bufio.NewWriterSize(f, 64*1024)}
+	lf.elem = fl.lru.PushFront(lf)
+	fl.files[p] = lf
+	fl.useLocked(lf)
+	evicted := fl.evictLocked()
+	fl.mu.Unlock()
+
+	fl.closeFiles(evicted)
+	return lf, nil
+}
+
+func (fl *FileLoggerService) useLocked(lf *logFile) {
+	lf.refs++
+	lf.lastUsed = time.Now()
+	fl.lru.MoveToFront(lf.elem)
+}
+
+func (fl *FileLoggerService) release(lf *logFile) {
+	fl.mu.Lock()
+	lf.refs--
+	closing := lf.failed && lf.refs == 0
+	fl.mu.Unlock()
+	if closing {
+		// the buffered data cannot be written anymore
+		if err := lf.f.Close(); err != nil {
+			log.Error().Err(err).Msgf("Closing %s", lf.path)
+		}
+	}
+}
+
+// discard removes a file whose writer failed, so that the next write reopens it.
+// A bufio.Writer keeps returning its first error.
+func (fl *FileLoggerService) discard(lf *logFile) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.files[lf.path] == lf {
+		fl.removeLocked(lf)
+	}
+	lf.failed = true
+}
+
+func (fl *FileLoggerService) removeLocked(lf *logFile) {
+	fl.lru.Remove(lf.elem)
+	delete(fl.files, lf.path)
+}
+
+// evictLocked removes the least recently used files that are not in use until at most MaxOpenFiles are open.
+func (fl *FileLoggerService) evictLocked() []*logFile {
+	var evicted []*logFile
+	for e := fl.lru.Back(); e != nil && len(fl.files) > fl.MaxOpenFiles; {
+		lf := e.Value.(*logFile)
+		e = e.Prev()
+		if lf.refs > 0 {
+			continue
+		}
+		fl.removeLocked(lf)
+		evicted = append(evicted, lf)
+	}
+	return evicted
+}
+
+func (fl *FileLoggerService) closeFiles(lfs []*logFile) {
+	for _, lf := range lfs {
+		if err := lf.close(fl.Fsync != FsyncNever); err != nil {
+			log.Error().Err(err).Msgf("Closing %s", lf.path)
+		}
+	}
+}
+
+func (fl *FileLoggerService) closeIdle() {
+	fl.mu.Lock()
+	var idle []*logFile
+	now := time.Now()
+	for e := fl.lru.Back(); e != nil; {
+		lf := e.Value.(*logFile)
+		e = e.Prev()
+		if lf.refs == 0 && now.Sub(lf.lastUsed) > fl.IdleTimeout {
+			fl.removeLocked(lf)
+			idle = append(idle, lf)
+		}
+	}
+	fl.mu.Unlock()
+	fl.closeFiles(idle)
+}
+
+func (fl *FileLoggerService) syncAll() {
+	fl.mu.Lock()
+	lfs := make([]*logFile, 0, len(fl.files))
+	for _, lf := range fl.files {
+		// prevent the file from being closed, but don't count this as a use
+		lf.refs++
+		lfs = append(lfs, lf)
+	}
+	fl.mu.Unlock()
+	for _, lf := range lfs {
+		if err := lf.sync(); err != nil {
+			log.Error().Err(err).Msgf("Syncing %s", lf.path)
+		}
+		fl.release(lf)
+	}
+}
+
+// write appends the formatted messages to the file. They are written as a whole
+// and are not interleaved with messages from other batches.
+func (fl *FileLoggerService) write(p string, b []byte) error {
+	if err := fl.ensureDir(p); err != nil {
+		return err
+	}
+	lf, err := fl.acquire(p)
+	if err != nil {
+		return err
+	}
+	defer fl.release(lf)
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if _, err := lf.w.Write(b); err != nil {
+		fl.discard(lf)
 		return errors.Errorf("writing to %s: %w", p, err)
 	}
-	if _, err := f.Write([]byte("\n")); err != nil {
+	if err := lf.w.Flush(); err != nil {
+		fl.discard(lf)
 		return errors.Errorf("writing to %s: %w", p, err)
 	}
-
-	if err := f.Close(); err != nil {
-		return errors.Errorf("closing %s: %w", p, err)
+	lf.dirty = true
+	if fl.Fsync == FsyncBatch {
+		lf.dirty = false
+		if err := lf.f.Sync(); err != nil {
+			return errors.Errorf("syncing %s: %w", p, err)
+		}
 	}
 	return nil
 }
+
+func (fl *FileLoggerService) format(m LogtailMsg) ([]byte, error) {
+	if fl.Redactor != nil {
+		m.Msg = fl.Redactor.Redact(m.Msg)
+	}
+	if fl.Format == FormatText {
+		return formatText(m)
+	}
+	return formatJSON(m)
+}
+
+// FileBatch collects formatted messages until they are written with Write.
+// Nothing is written to the files before.
+type FileBatch struct {
+	fl *FileLoggerService
+	// files in the order of their first message
+	paths  []string
+	byPath map[string][]byte
+	// the path is resolved once per file, as most messages of a batch go to the same file
+	resolved map[layoutKey]string
+	errs     error
+}
+
+func (fl *FileLoggerService) NewBatch() *FileBatch {
+	return &FileBatch{
+		fl:       fl,
+		byPath:   map[string][]byte{},
+		resolved: map[layoutKey]string{},
+	}
+}
+
+// Add formats the message. Messages that cannot be formatted are skipped, the error is returned by Write.
+func (b *FileBatch) Add(m LogtailMsg) {
+	k := b.fl.Layout.key(m)
+	p, ok := b.resolved[k]
+	if !ok {
+		var err error
+		if p, err = b.fl.resolve(k); err != nil {
+			b.errs = errors.Join(b.errs, err)
+			return
+		}
+		b.resolved[k] = p
+	}
+	f, err := b.fl.format(m)
+	if err != nil {
+		b.errs = errors.Join(b.errs, errors.Errorf("formatting message: %w", err))
+		return
+	}
+	if _, ok := b.byPath[p]; !ok {
+		b.paths = append(b.paths, p)
+	}
+	b.byPath[p] = append(b.byPath[p], f...)
+}
+
+// Write appends the messages to their files.
+func (b *FileBatch) Write() error {
+	errs := b.errs
+	for _, p := range b.paths {
+		errs = errors.Join(errs, b.fl.write(p, b.byPath[p]))
+	}
+	return errs
+}
+
+// LogBatch writes the messages to the files of their nodes.
+func (fl *FileLoggerService) LogBatch(msgs []LogtailMsg) error {
+	b := fl.NewBatch()
+	for _, m := range msgs {
+		b.Add(m)
+	}
+	return b.Write()
+}
+
+func (fl *FileLoggerService) Log(m LogtailMsg) error {
+	return fl.LogBatch([]LogtailMsg{m})
+}
+
+// Close flushes and closes all files.
+func (fl *FileLoggerService) Close() error {
+	close(fl.done)
+	fl.wg.Wait()
+
+	fl.mu.Lock()
+	lfs := make([]*logFile, 0, len(fl.files))
+	for _, lf := range fl.files {
+		fl.removeLocked(lf)
+		lfs = append(lfs, lf)
+	}
+	fl.mu.Unlock()
+
+	var errs error
+	for _, lf := range lfs {
+		errs = errors.Join(errs, lf.close(fl.Fsync != FsyncNever))
+	}
+	return errs
+}
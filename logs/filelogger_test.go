@@ -0,0 +1,236 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/qup42/loghead/types"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileLogger(t testing.TB, c types.FileLoggerConfig) *FileLoggerService {
+	c.Dir = t.TempDir()
+	if c.Fsync == "" {
+		c.Fsync = FsyncNever
+	}
+	if c.Format == "" {
+		c.Format = FormatJSON
+	}
+	fl, err := NewFileLoggerService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fl
+}
+
+func testMsgs(privateID string, n int) []LogtailMsg {
+	msgs := make([]LogtailMsg, n)
+	for i := range msgs {
+		msgs[i] = LogtailMsg{
+			Msg: map[string]interface{}{
+				"logtail": map[string]interface{}{"proc_id": 1, "proc_seq": i + 1},
+				"text":    fmt.Sprintf("magicsock: disco: node [abc] d:123 now using 192.0.2.1:41641 (%d)\n", i),
+			},
+			Collection: TailnodeCollection,
+			PrivateID:  privateID,
+		}
+	}
+	return msgs
+}
+
+func readLines(t *testing.T, p string) []map[string]interface{} {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			t.Fatalf("invalid line %q: %s", s.Text(), err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestFileLoggerConcurrentBatches(t *testing.T) {
+	// a single open file forces the files to be evicted while other batches are written
+	fl := newTestFileLogger(t, types.FileLoggerConfig{MaxOpenFiles: 1, Fsync: FsyncBatch})
+	nodes := []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := fl.LogBatch(testMsgs(node, 100)); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range nodes {
+		lines := readLines(t, filepath.Join(fl.BaseDir, TailnodeCollection, node))
+		if len(lines) != 1000 {
+			t.Fatalf(`node %s has %d lines, want %d`, node, len(lines), 1000)
+		}
+		// batches are not interleaved
+		for i, l := range lines {
+			seq := l["logtail"].(map[string]interface{})["proc_seq"].(float64)
+			if int(seq) != i%100+1 {
+				t.Fatalf(`node %s line %d has proc_seq %d, want %d`, node, i, int(seq), i%100+1)
+			}
+		}
+	}
+}
+
+func TestFileLoggerCloseIdle(t *testing.T) {
+	fl := newTestFileLogger(t, types.FileLoggerConfig{MaxOpenFiles: 10, IdleTimeout: 10 * time.Millisecond})
+	defer fl.Close()
+	if err := fl.LogBatch(testMsgs("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fl.mu.Lock()
+		open := len(fl.files)
+		fl.mu.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle file was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fl.LogBatch(testMsgs("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileLoggerWriteError(t *testing.T) {
+	fl := newTestFileLogger(t, types.FileLoggerConfig{MaxOpenFiles: 10, IdleTimeout: time.Hour})
+	defer fl.Close()
+	if err := fl.LogBatch(testMsgs("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(fl.BaseDir, TailnodeCollection, "a")
+	// the disk is full
+	fl.mu.Lock()
+	fl.files[p].f.Close()
+	fl.mu.Unlock()
+	if err := fl.LogBatch(testMsgs("a", 1)); err == nil {
+		t.Fatal("LogBatch() to a failing file succeeded")
+	}
+	// the file is reopened
+	if err := fl.LogBatch(testMsgs("a", 2)); err != nil {
+		t.Fatal(err)
+	}
+	fl.mu.Lock()
+	open := len(fl.files)
+	fl.mu.Unlock()
+	if open != 1 {
+		t.Fatalf(`%d open files, want 1`, open)
+	}
+	if lines := readLines(t, p); len(lines) != 3 {
+		t.Fatalf(`%d lines, want 3`, len(lines))
+	}
+}
+
+// logOpenWriteClose is the previous implementation of FileLoggerService.Log,
+// which opens and closes the file for every message. It is kept for comparison.
+func logOpenWriteClose(baseDir string, m LogtailMsg) error {
+	p := filepath.Join(baseDir, m.Collection, m.PrivateID)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(m.Msg)
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("\n")); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func benchmarkOpenWriteClose(msgs []LogtailMsg) func(b *testing.B) {
+	return func(b *testing.B) {
+		fl := newTestFileLogger(b, types.FileLoggerConfig{MaxOpenFiles: 10})
+		defer fl.Close()
+		if _, err := fl.path(msgs[0]); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for range b.N {
+			for _, m := range msgs {
+				if err := logOpenWriteClose(fl.BaseDir, m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkLogBatch(msgs []LogtailMsg, c types.FileLoggerConfig) func(b *testing.B) {
+	return func(b *testing.B) {
+		fl := newTestFileLogger(b, c)
+		defer fl.Close()
+		b.ResetTimer()
+		for range b.N {
+			if err := fl.LogBatch(msgs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkFileLogger(b *testing.B) {
+	const batchSize = 100
+	msgs := testMsgs("a", batchSize)
+
+	b.Run("OpenWriteClose", benchmarkOpenWriteClose(msgs))
+	b.Run("Log", func(b *testing.B) {
+		fl := newTestFileLogger(b, types.FileLoggerConfig{MaxOpenFiles: 10})
+		defer fl.Close()
+		b.ResetTimer()
+		for range b.N {
+			for _, m := range msgs {
+				if err := fl.Log(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("LogBatch", benchmarkLogBatch(msgs, types.FileLoggerConfig{MaxOpenFiles: 10}))
+	b.Run("LogBatchFsync", benchmarkLogBatch(msgs, types.FileLoggerConfig{MaxOpenFiles: 10, Fsync: FsyncBatch}))
+}
+
+// TestLogBatchFasterThanOpenWriteClose guards against regressions that make
+// keeping the files open pointless.
+func TestLogBatchFasterThanOpenWriteClose(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping benchmark comparison in short mode")
+	}
+	msgs := testMsgs("a", 100)
+	owc := testing.Benchmark(benchmarkOpenWriteClose(msgs))
+	batch := testing.Benchmark(benchmarkLogBatch(msgs, types.FileLoggerConfig{MaxOpenFiles: 10}))
+	t.Logf("OpenWriteClose: %s, LogBatch: %s", owc, batch)
+	// LogBatch has to be at least a third faster
+	if batch.NsPerOp()*3 > owc.NsPerOp()*2 {
+		t.Fatalf(`LogBatch takes %d ns/op, OpenWriteClose %d ns/op`, batch.NsPerOp(), owc.NsPerOp())
+	}
+}
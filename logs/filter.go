@@ -0,0 +1,175 @@
+package logs
+
+import (
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"golang.org/x/time/rate"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	FilterDrop   = "drop"
+	FilterKeep   = "keep"
+	FilterSample = "sample"
+)
+
+// limiters of a sampling rule are reset once there are more keys than this
+const maxSampleKeys = 10000
+
+type filterRule struct {
+	name       string
+	action     string
+	collection string
+	node       string
+	field      []string
+	match      *regexp.Regexp
+	rate       float64
+	key        []string
+	limit      float64
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// FilterService drops and samples entries according to a list of rules.
+// The first rule that matches an entry decides what happens to it. Entries that match no rule are kept.
+type FilterService struct {
+	rules   []*filterRule
+	Entries *prometheus.CounterVec
+}
+
+func NewFilterService(c []types.FilterRuleConfig, reg prometheus.Registerer) (*FilterService, error) {
+	fs := &FilterService{
+		Entries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_filter_entries_total",
+				Help: "Number of log entries dropped by filter rules, by rule and reason (dropped or sampled).",
+			},
+			[]string{"rule", "reason"}),
+	}
+	for i, rc := range c {
+		r := &filterRule{
+			name:       rc.Name,
+			action:     rc.Action,
+			collection: rc.Collection,
+			node:       rc.Node,
+			rate:       rc.Rate,
+			limit:      rc.Limit,
+			limiters:   map[string]*rate.Limiter{},
+		}
+		if r.name == "" {
+			r.name = fmt.Sprintf("%d", i)
+		}
+		switch r.action {
+		case FilterDrop, FilterKeep:
+		case FilterSample:
+			if r.limit <= 0 && (r.rate < 0 || r.rate > 1) {
+				return nil, errors.Errorf("filter %s: rate must be between 0 and 1", r.name)
+			}
+		default:
+			return nil, errors.Errorf("filter %s: unknown action %s", r.name, r.action)
+		}
+		if rc.Match != "" {
+			re, err := regexp.Compile(rc.Match)
+			if err != nil {
+				return nil, errors.Errorf("filter %s: invalid match: %w", r.name, err)
+			}
+			r.match = re
+			r.field = []string{"text"}
+			if rc.Field != "" {
+				r.field = strings.Split(rc.Field, ".")
+			}
+		}
+		if rc.Key != "" {
+			r.key = strings.Split(rc.Key, ".")
+		}
+		fs.rules = append(fs.rules, r)
+	}
+	reg.MustRegister(fs.Entries)
+	return fs, nil
+}
+
+// lookupField returns the value at the dotted path in the entry as a string.
+func lookupField(m map[string]interface{}, path []string) (string, bool) {
+	var v interface{} = m
+	for _, k := range path {
+		mm, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		v, ok = mm[k]
+		if !ok {
+			return "", false
+		}
+	}
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(v), true
+}
+
+func (r *filterRule) matches(msg LogtailMsg) bool {
+	if r.collection != "" && r.collection != msg.Collection {
+		return false
+	}
+	if r.node != "" && r.node != msg.PrivateID {
+		return false
+	}
+	if r.match != nil {
+		v, ok := lookupField(msg.Msg, r.field)
+		if !ok || !r.match.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// sample reports whether the entry is kept.
+func (r *filterRule) sample(msg LogtailMsg) bool {
+	if r.limit <= 0 {
+		return rand.Float64() < r.rate
+	}
+	key := msg.PrivateID
+	if r.key != nil {
+		key, _ = lookupField(msg.Msg, r.key)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.limiters[key]
+	if !ok {
+		if len(r.limiters) >= maxSampleKeys {
+			r.limiters = map[string]*rate.Limiter{}
+		}
+		l = rate.NewLimiter(rate.Limit(r.limit), max(int(r.limit), 1))
+		r.limiters[key] = l
+	}
+	return l.Allow()
+}
+
+// Process reports whether the entry is kept.
+func (fs *FilterService) Process(msg LogtailMsg) bool {
+	for _, r := range fs.rules {
+		if !r.matches(msg) {
+			continue
+		}
+		switch r.action {
+		case FilterKeep:
+			return true
+		case FilterDrop:
+			fs.Entries.With(prometheus.Labels{"rule": r.name, "reason": "dropped"}).Inc()
+			return false
+		case FilterSample:
+			if r.sample(msg) {
+				return true
+			}
+			fs.Entries.With(prometheus.Labels{"rule": r.name, "reason": "sampled"}).Inc()
+			return false
+		}
+	}
+	return true
+}
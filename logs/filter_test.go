@@ -0,0 +1,63 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/qup42/loghead/types"
+	"testing"
+)
+
+func TestFilterProcess(t *testing.T) {
+	fs, err := NewFilterService([]types.FilterRuleConfig{
+		{Name: "keep-errors", Action: FilterKeep, Match: "(?i)error"},
+		{Name: "drop-netcheck", Action: FilterDrop, Match: "^netcheck: "},
+		{Name: "drop-linux", Action: FilterDrop, Field: "Hostinfo.OS", Match: "^linux$"},
+		{Name: "drop-traffic", Action: FilterDrop, Collection: TailtrafficCollection},
+		{Name: "sample-magicsock", Action: FilterSample, Match: "^magicsock: ", Limit: 2},
+		{Name: "sample-none", Action: FilterSample, Node: "quiet", Rate: 0},
+	}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := func(collection, node string, m map[string]interface{}) LogtailMsg {
+		return LogtailMsg{Msg: m, Collection: collection, PrivateID: node}
+	}
+	tests := []struct {
+		name string
+		msg  LogtailMsg
+		keep bool
+	}{
+		{name: "no rule", msg: msg(TailnodeCollection, "a", map[string]interface{}{"text": "wgengine: Reconfig"}), keep: true},
+		{name: "netcheck", msg: msg(TailnodeCollection, "a", map[string]interface{}{"text": "netcheck: report"}), keep: false},
+		{name: "netcheck error", msg: msg(TailnodeCollection, "a", map[string]interface{}{"text": "netcheck: Error"}), keep: true},
+		{name: "field", msg: msg(TailnodeCollection, "a", map[string]interface{}{"Hostinfo": map[string]interface{}{"OS": "linux"}}), keep: false},
+		{name: "other field value", msg: msg(TailnodeCollection, "a", map[string]interface{}{"Hostinfo": map[string]interface{}{"OS": "windows"}}), keep: true},
+		{name: "collection", msg: msg(TailtrafficCollection, "a", map[string]interface{}{}), keep: false},
+		{name: "rate 0", msg: msg(TailnodeCollection, "quiet", map[string]interface{}{"text": "x"}), keep: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if keep := fs.Process(tc.msg); keep != tc.keep {
+				t.Fatalf(`Process(%v) = %t, want %t`, tc.msg.Msg, keep, tc.keep)
+			}
+		})
+	}
+
+	t.Run("limit per key", func(t *testing.T) {
+		kept := map[string]int{}
+		for range 10 {
+			for _, node := range []string{"a", "b"} {
+				if fs.Process(msg(TailnodeCollection, node, map[string]interface{}{"text": "magicsock: endpoints changed"})) {
+					kept[node]++
+				}
+			}
+		}
+		if kept["a"] != 2 || kept["b"] != 2 {
+			t.Fatalf(`kept %v entries, want 2 per node`, kept)
+		}
+		if sampled := testutil.ToFloat64(fs.Entries.WithLabelValues("sample-magicsock", "sampled")); sampled != 16 {
+			t.Fatalf(`sampled = %f, want 16`, sampled)
+		}
+	})
+}
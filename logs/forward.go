@@ -8,10 +8,12 @@ import (
 
 type ForwardingService struct {
 	Addr string
+	// Redactor is applied to the entries before they are forwarded, if set
+	Redactor *Redactor
 }
 
 func NewForwardingService(addr string) *ForwardingService {
-	return &ForwardingService{addr}
+	return &ForwardingService{Addr: addr}
 }
 
 func (fwd *ForwardingService) Forward(m []byte) error {
@@ -1,8 +1,9 @@
 package logs
 
 import (
-	"github.com/cockroachdb/errors"
 	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
 )
 
 type HostInfo struct {
@@ -25,15 +26,28 @@ type HostInfo struct {
 }
 
 type HostInfoService struct {
+	Invalid prometheus.Counter
 }
 
-func (hs *HostInfoService) Process(msg LogtailMsg) error {
+func NewHostInfoService(reg prometheus.Registerer) *HostInfoService {
+	hs := &HostInfoService{
+		Invalid: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "loghead_hostinfo_invalid_total",
+			Help: "Number of log entries with a Hostinfo that could not be read.",
+		}),
+	}
+	reg.MustRegister(hs.Invalid)
+	return hs
+}
+
+// Process reads the Hostinfo of the entry. An invalid Hostinfo is logged and counted,
+// it does not affect the processing of the entry.
+func (hs *HostInfoService) Process(msg LogtailMsg) {
 	if h, ok := msg.Msg["Hostinfo"]; ok {
 		var hi HostInfo
-		err := mapstructure.Decode(h, &hi)
-		if err != nil {
-			return errors.Errorf("unmarshaling HostInfo: %w", err)
+		if err := mapstructure.Decode(h, &hi); err != nil {
+			log.Warn().Err(err).Str("private_id", msg.PrivateID).Msg("Invalid Hostinfo")
+			hs.Invalid.Inc()
 		}
 	}
-	return nil
 }
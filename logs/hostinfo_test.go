@@ -1 +1,30 @@
 package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func TestHostInfoProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     map[string]interface{}
+		invalid float64
+	}{
+		{name: "no hostinfo", msg: map[string]interface{}{"text": "a"}},
+		{name: "valid", msg: map[string]interface{}{"Hostinfo": map[string]interface{}{"OS": "linux", "Hostname": "a"}}},
+		{name: "invalid field", msg: map[string]interface{}{"Hostinfo": map[string]interface{}{"OS": 1}}, invalid: 1},
+		{name: "not an object", msg: map[string]interface{}{"Hostinfo": "linux"}, invalid: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := NewHostInfoService(prometheus.NewRegistry())
+			hs.Process(LogtailMsg{Msg: tc.msg, PrivateID: "abc"})
+			if invalid := testutil.ToFloat64(hs.Invalid); invalid != tc.invalid {
+				t.Fatalf(`invalid = %f, want %f`, invalid, tc.invalid)
+			}
+		})
+	}
+}
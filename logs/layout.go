@@ -0,0 +1,161 @@
+package logs
+
+import (
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatJSON writes each entry as a JSON object on a line
+	FormatJSON = "json"
+	// FormatText writes the `text` field of the entries prefixed with a timestamp,
+	// similar to the local logs of tailscaled
+	FormatText = "text"
+)
+
+const DefaultLayout = "{collection}/{node}"
+
+var layoutPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// Layout is a template for the path of a log file relative to the filelogger directory.
+// The placeholders are
+//   - {collection}: the collection
+//   - {node}: the private id of the node
+//   - {node_name}: the tailnet name of the node, the private id if it is unknown
+//   - {date}: the day the entry was received (YYYY-MM-DD, UTC)
+type Layout struct {
+	Template string
+	// the path elements of the template, split into literals and placeholders
+	elems [][]string
+}
+
+func NewLayout(template string) (Layout, error) {
+	if template == "" {
+		template = DefaultLayout
+	}
+	for _, p := range layoutPlaceholder.FindAllString(template, -1) {
+		switch p {
+		case "{collection}", "{node}", "{node_name}", "{date}":
+		default:
+			return Layout{}, errors.Errorf("unknown placeholder %s in layout %s", p, template)
+		}
+	}
+	l := Layout{Template: template}
+	for _, e := range strings.Split(template, "/") {
+		if !filepath.IsLocal(e) {
+			return Layout{}, errors.Errorf("layout %s is not a relative path inside the filelogger directory", template)
+		}
+		var parts []string
+		last := 0
+		for _, loc := range layoutPlaceholder.FindAllStringIndex(e, -1) {
+			if loc[0] > last {
+				parts = append(parts, e[last:loc[0]])
+			}
+			parts = append(parts, e[loc[0]:loc[1]])
+			last = loc[1]
+		}
+		if last < len(e) {
+			parts = append(parts, e[last:])
+		}
+		l.elems = append(l.elems, parts)
+	}
+	return l, nil
+}
+
+// layoutKey holds the fields of a message that its path depends on.
+// Messages with the same key are written to the same file.
+type layoutKey struct {
+	collection string
+	node       string
+	nodeName   string
+	year       int
+	month      time.Month
+	day        int
+}
+
+func (l Layout) key(m LogtailMsg) layoutKey {
+	k := layoutKey{collection: m.Collection, node: m.PrivateID, nodeName: m.PrivateID}
+	if m.Peer != nil && m.Peer.NodeName != "" {
+		k.nodeName = m.Peer.NodeName
+	}
+	t := m.ServerTime
+	if t.IsZero() {
+		t = time.Now()
+	}
+	k.year, k.month, k.day = t.UTC().Date()
+	return k
+}
+
+// Path returns the path elements of the message's log file.
+func (l Layout) Path(m LogtailMsg) []string {
+	return l.path(l.key(m))
+}
+
+func (l Layout) path(k layoutKey) []string {
+	elems := make([]string, len(l.elems))
+	for i, parts := range l.elems {
+		var b strings.Builder
+		for _, p := range parts {
+			switch p {
+			case "{collection}":
+				b.WriteString(k.collection)
+			case "{node}":
+				b.WriteString(k.node)
+			case "{node_name}":
+				b.WriteString(k.nodeName)
+			case "{date}":
+				b.WriteString(time.Date(k.year, k.month, k.day, 0, 0, 0, 0, time.UTC).Format(time.DateOnly))
+			default:
+				b.WriteString(p)
+			}
+		}
+		elems[i] = b.String()
+	}
+	return elems
+}
+
+// formatText renders the message as one or more lines of text.
+// Each line is prefixed with the client time of the entry, or the server time if it is unknown.
+func formatText(m LogtailMsg) ([]byte, error) {
+	t := m.ServerTime
+	if meta, ok, err := m.Meta(); err == nil && ok && !meta.ClientTime.IsZero() {
+		t = meta.ClientTime
+	}
+	prefix := t.UTC().Format("2006/01/02 15:04:05.000000") + " "
+
+	text, ok := m.Msg["text"].(string)
+	if !ok {
+		// structured entries are written as JSON without the logtail metadata
+		rest := make(map[string]interface{}, len(m.Msg))
+		for k, v := range m.Msg {
+			if k != "logtail" {
+				rest[k] = v
+			}
+		}
+		b, err := json.Marshal(rest)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		b.WriteString(prefix)
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String()), nil
+}
+
+func formatJSON(m LogtailMsg) ([]byte, error) {
+	b, err := json.Marshal(m.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,90 @@
+package logs
+
+import (
+	"github.com/qup42/loghead/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLayoutPath(t *testing.T) {
+	msg := LogtailMsg{
+		Collection: TailnodeCollection,
+		PrivateID:  "abc",
+		ServerTime: time.Date(2024, 12, 22, 23, 0, 0, 0, time.FixedZone("", -2*60*60)),
+	}
+	peerMsg := msg
+	peerMsg.Peer = &types.PeerIdentity{NodeName: "host.tail-scale.ts.net"}
+	tests := []struct {
+		template string
+		msg      LogtailMsg
+		out      []string
+	}{
+		{template: "", msg: msg, out: []string{TailnodeCollection, "abc"}},
+		{template: "{collection}/{date}/{node}", msg: msg, out: []string{TailnodeCollection, "2024-12-23", "abc"}},
+		{template: "{node_name}.log", msg: msg, out: []string{"abc.log"}},
+		{template: "{node_name}.log", msg: peerMsg, out: []string{"host.tail-scale.ts.net.log"}},
+		{template: "logs-{collection}/{node}.{date}.log", msg: msg, out: []string{"logs-" + TailnodeCollection, "abc.2024-12-23.log"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.template, func(t *testing.T) {
+			l, err := NewLayout(tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := l.Path(tc.msg); !reflect.DeepEqual(out, tc.out) {
+				t.Fatalf(`Layout("%s").Path() = %q, want %q`, tc.template, out, tc.out)
+			}
+		})
+	}
+
+	for _, template := range []string{"{collection}/{hostname}", "../{node}", "/var/log/{node}", "{collection}//{node}"} {
+		if _, err := NewLayout(template); err == nil {
+			t.Fatalf(`NewLayout("%s") succeeded, want error`, template)
+		}
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	serverTime := time.Date(2024, 12, 22, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		msg  map[string]interface{}
+		out  string
+	}{
+		{
+			name: "text",
+			msg: map[string]interface{}{
+				"logtail": map[string]interface{}{"client_time": "2024-12-22T11:59:59.123456789Z"},
+				"text":    "magicsock: endpoints changed\n",
+			},
+			out: "2024/12/22 11:59:59.123456 magicsock: endpoints changed\n",
+		},
+		{
+			name: "multiple lines",
+			msg:  map[string]interface{}{"text": "a\nb\n"},
+			out:  "2024/12/22 12:00:00.000000 a\n2024/12/22 12:00:00.000000 b\n",
+		},
+		{
+			name: "structured",
+			msg: map[string]interface{}{
+				"logtail": map[string]interface{}{"proc_id": 1},
+				"metrics": "N2anetmon_link_change_eqS0202",
+			},
+			out: "2024/12/22 12:00:00.000000 {\"metrics\":\"N2anetmon_link_change_eqS0202\"}\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := formatText(LogtailMsg{Msg: tc.msg, ServerTime: serverTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tc.out {
+				t.Fatalf(`formatText(%v) = %q, want %q`, tc.msg, out, tc.out)
+			}
+		})
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
-	"net/http"
 	"strings"
 )
 
@@ -31,9 +29,10 @@ type MetricsService struct {
 	CounterPromMetrics map[string]*prometheus.CounterVec
 }
 
-func NewMetricsService() *MetricsService {
+// NewMetricsService registers the client metrics on reg as they are received.
+func NewMetricsService(reg *prometheus.Registry) *MetricsService {
 	return &MetricsService{
-		Registry:           prometheus.NewRegistry(),
+		Registry:           reg,
 		Metrics:            map[string]map[int]Metric{},
 		GaugePromMetrics:   map[string]*prometheus.GaugeVec{},
 		CounterPromMetrics: map[string]*prometheus.CounterVec{},
@@ -196,7 +195,3 @@ func (ms *MetricsService) processMetrics(in string, private_id string) {
 		}
 	}
 }
-
-func (ms *MetricsService) PromHandler() http.Handler {
-	return promhttp.HandlerFor(ms.Registry, promhttp.HandlerOpts{Registry: ms.Registry})
-}
@@ -1,6 +1,7 @@
 package logs
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"reflect"
 	"testing"
 )
@@ -69,7 +70,7 @@ func TestProcessMetrics(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.in, func(t *testing.T) {
-			ms := NewMetricsService()
+			ms := NewMetricsService(prometheus.NewRegistry())
 			ms.processMetrics(tc.in, "")
 			out := map[string]map[int]Metric{"": tc.out}
 
@@ -0,0 +1,145 @@
+package logs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/cockroachdb/errors"
+	"github.com/qup42/loghead/types"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+const (
+	// RedactMask replaces sensitive values with a placeholder
+	RedactMask = "mask"
+	// RedactHash replaces sensitive values with a keyed hash, so equal values can still be correlated
+	RedactHash = "hash"
+	// RedactDrop removes fields that contain sensitive values
+	RedactDrop = "drop"
+)
+
+const redactedPlaceholder = "[REDACTED]"
+
+// a detector finds sensitive values in a string.
+// If valid is not nil, only matches for which it returns true are sensitive.
+type detector struct {
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+func isIP(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+var detectors = map[string]detector{
+	"ipv4": {re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)},
+	// candidates are validated, as the pattern also matches e.g. times
+	"ipv6":       {re: regexp.MustCompile(`(?i)[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}`), valid: isIP},
+	"nodekey":    {re: regexp.MustCompile(`nodekey:[0-9a-f]{64}`)},
+	"machinekey": {re: regexp.MustCompile(`mkey:[0-9a-f]{64}`)},
+	"discokey":   {re: regexp.MustCompile(`discokey:[0-9a-f]{64}`)},
+	"email":      {re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+}
+
+// Redactor removes sensitive values from log entries.
+type Redactor struct {
+	Name      string
+	Action    string
+	detectors []detector
+	key       []byte
+}
+
+func NewRedactor(name string, c types.RedactionProfileConfig) (*Redactor, error) {
+	r := &Redactor{Name: name, Action: c.Action}
+	switch c.Action {
+	case RedactMask, RedactDrop:
+	case RedactHash:
+		if c.Key == "" {
+			return nil, errors.Errorf("redaction profile %s: hash requires a key", name)
+		}
+		r.key = []byte(c.Key)
+	default:
+		return nil, errors.Errorf("redaction profile %s: unknown action %s", name, c.Action)
+	}
+	for _, d := range c.Detectors {
+		det, ok := detectors[d]
+		if !ok {
+			return nil, errors.Errorf("redaction profile %s: unknown detector %s", name, d)
+		}
+		r.detectors = append(r.detectors, det)
+	}
+	for _, p := range c.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Errorf("redaction profile %s: invalid pattern %s: %w", name, p, err)
+		}
+		r.detectors = append(r.detectors, detector{re: re})
+	}
+	return r, nil
+}
+
+func (r *Redactor) replacement(v string) string {
+	if r.Action == RedactHash {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(v))
+		return "[h:" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+	}
+	return redactedPlaceholder
+}
+
+// redactString returns the redacted string and whether it contained sensitive values.
+func (r *Redactor) redactString(s string) (string, bool) {
+	found := false
+	for _, d := range r.detectors {
+		s = d.re.ReplaceAllStringFunc(s, func(m string) string {
+			if d.valid != nil {
+				// the ipv6 pattern may include trailing colons of e.g. `[::1]:41641`
+				if t := strings.TrimRight(m, ":"); t != m && d.valid(t) {
+					found = true
+					return r.replacement(t) + m[len(t):]
+				}
+				if !d.valid(m) {
+					return m
+				}
+			}
+			found = true
+			return r.replacement(m)
+		})
+	}
+	return s, found
+}
+
+// redact returns a redacted copy of v. drop is true if v should be removed.
+func (r *Redactor) redact(v interface{}) (_ interface{}, drop bool) {
+	switch v := v.(type) {
+	case string:
+		s, found := r.redactString(v)
+		return s, found && r.Action == RedactDrop
+	case map[string]interface{}:
+		return r.Redact(v), false
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			if e, drop := r.redact(e); !drop {
+				out = append(out, e)
+			}
+		}
+		return out, false
+	default:
+		return v, false
+	}
+}
+
+// Redact returns a copy of the entry with the sensitive values removed. The entry is not modified.
+func (r *Redactor) Redact(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if v, drop := r.redact(v); !drop {
+			out[k] = v
+		}
+	}
+	return out
+}
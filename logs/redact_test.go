@@ -0,0 +1,84 @@
+package logs
+
+import (
+	"github.com/qup42/loghead/types"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactString(t *testing.T) {
+	all := []string{"ipv4", "ipv6", "nodekey", "machinekey", "discokey", "email"}
+	key := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{in: "magicsock: endpoints changed: 192.0.2.1:41641 (stun), 10.0.0.1:41641 (local)", out: "magicsock: endpoints changed: [REDACTED]:41641 (stun), [REDACTED]:41641 (local)"},
+		{in: "using [2001:db8::1]:41641 and fd7a:115c:a1e0::1", out: "using [[REDACTED]]:41641 and [REDACTED]"},
+		{in: "2024/12/22 12:00:00 took 1.5s", out: "2024/12/22 12:00:00 took 1.5s"},
+		{in: "999.1.1.1 is no address", out: "999.1.1.1 is no address"},
+		{in: "control: [v1] nodekey:" + key + " registered", out: "control: [v1] [REDACTED] registered"},
+		{in: "mkey:" + key + " discokey:" + key, out: "[REDACTED] [REDACTED]"},
+		{in: "user alice@example.com logged in", out: "user [REDACTED] logged in"},
+		{in: "custom secret-1234", out: "custom [REDACTED]"},
+	}
+
+	r, err := NewRedactor("test", types.RedactionProfileConfig{Detectors: all, Patterns: []string{`secret-\d+`}, Action: RedactMask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			if out, _ := r.redactString(tc.in); out != tc.out {
+				t.Fatalf(`redactString("%s") = "%s", want "%s"`, tc.in, out, tc.out)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	in := map[string]interface{}{
+		"text":    "peer 192.0.2.1 connected",
+		"logtail": map[string]interface{}{"proc_id": float64(1)},
+		"Hostinfo": map[string]interface{}{
+			"Hostname": "host",
+			"Endpoints": []interface{}{
+				"192.0.2.1:41641",
+				"192.0.2.1:41641",
+				"derp",
+			},
+		},
+	}
+	hashed, err := NewRedactor("hash", types.RedactionProfileConfig{Detectors: []string{"ipv4"}, Action: RedactHash, Key: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := hashed.Redact(in)
+	endpoints := out["Hostinfo"].(map[string]interface{})["Endpoints"].([]interface{})
+	if endpoints[0] != endpoints[1] || endpoints[0] == "192.0.2.1:41641" || !strings.HasPrefix(endpoints[0].(string), "[h:") {
+		t.Fatalf(`hashed endpoints = %v, want equal hashes`, endpoints)
+	}
+	if in["text"] != "peer 192.0.2.1 connected" {
+		t.Fatalf(`Redact modified its input`)
+	}
+
+	dropped, err := NewRedactor("drop", types.RedactionProfileConfig{Detectors: []string{"ipv4"}, Action: RedactDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"logtail": map[string]interface{}{"proc_id": float64(1)},
+		"Hostinfo": map[string]interface{}{
+			"Hostname":  "host",
+			"Endpoints": []interface{}{"derp"},
+		},
+	}
+	if out := dropped.Redact(in); !reflect.DeepEqual(out, want) {
+		t.Fatalf(`Redact() = %v, want %v`, out, want)
+	}
+
+	if _, err := NewRedactor("nokey", types.RedactionProfileConfig{Action: RedactHash}); err == nil {
+		t.Fatalf(`NewRedactor with hash but without key succeeded, want error`)
+	}
+}
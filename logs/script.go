@@ -0,0 +1,273 @@
+package logs
+
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"github.com/rs/zerolog/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"maps"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// time limit for running the top level statements of a script
+const scriptLoadTimeout = 5 * time.Second
+
+// ScriptService runs the function `process(entry, meta)` of a Starlark script for each entry.
+// The function returns the entry, a modified entry or None to drop it.
+// Scripts can emit derived entries with `emit(entry)` and count events with `count(name, n=1)`.
+type ScriptService struct {
+	Timeout time.Duration
+	process starlark.Callable
+
+	Errors *prometheus.CounterVec
+	Counts *prometheus.CounterVec
+}
+
+// invocation collects what a single call of `process` emitted.
+type invocation struct {
+	derived []map[string]interface{}
+}
+
+func NewScriptService(c types.ScriptConfig, reg prometheus.Registerer) (*ScriptService, error) {
+	src, err := os.ReadFile(c.File)
+	if err != nil {
+		return nil, errors.Errorf("reading script: %w", err)
+	}
+	return NewScriptServiceFromSource(c.File, src, c.Timeout, reg)
+}
+
+func NewScriptServiceFromSource(filename string, src []byte, timeout time.Duration, reg prometheus.Registerer) (*ScriptService, error) {
+	ss := &ScriptService{
+		Timeout: timeout,
+		Errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_script_errors_total",
+				Help: "Number of script invocations that failed, by reason (error or timeout). The entry is kept unchanged.",
+			},
+			[]string{"reason"}),
+		Counts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_script_count_total",
+				Help: "Counters incremented by the script with count(name).",
+			},
+			[]string{"name"}),
+	}
+
+	predeclared := starlark.StringDict{
+		"emit":  starlark.NewBuiltin("emit", ss.emit),
+		"count": starlark.NewBuiltin("count", ss.count),
+	}
+	thread := &starlark.Thread{Name: "load"}
+	timer := time.AfterFunc(scriptLoadTimeout, func() { thread.Cancel("timeout") })
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, filename, src, predeclared)
+	timer.Stop()
+	if err != nil {
+		return nil, errors.Errorf("loading script: %w", err)
+	}
+	process, ok := globals["process"].(starlark.Callable)
+	if !ok {
+		return nil, errors.Errorf("script %s does not define a function process(entry, meta)", filename)
+	}
+	ss.process = process
+	reg.MustRegister(ss.Errors, ss.Counts)
+	return ss, nil
+}
+
+func (ss *ScriptService) emit(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var entry *starlark.Dict
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &entry); err != nil {
+		return nil, err
+	}
+	v, err := fromStarlark(entry)
+	if err != nil {
+		return nil, errors.Errorf("emit: %w", err)
+	}
+	// not set while the script is loaded
+	inv, ok := thread.Local("invocation").(*invocation)
+	if !ok {
+		return nil, errors.New("emit: only allowed in process()")
+	}
+	inv.derived = append(inv.derived, v.(map[string]interface{}))
+	return starlark.None, nil
+}
+
+func (ss *ScriptService) count(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var n starlark.Value = starlark.MakeInt(1)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "n?", &n); err != nil {
+		return nil, err
+	}
+	f, ok := starlark.AsFloat(n)
+	if !ok || f < 0 {
+		return nil, errors.Errorf("count: n must be a non-negative number, got %s", n)
+	}
+	ss.Counts.With(prometheus.Labels{"name": name}).Add(f)
+	return starlark.None, nil
+}
+
+// Process runs the script for the entry and modifies it in place.
+// It returns whether the entry is kept and the entries the script emitted.
+// If the script fails or exceeds the time limit, the entry is kept unchanged.
+func (ss *ScriptService) Process(msg LogtailMsg) (bool, []LogtailMsg) {
+	entry, err := toStarlark(msg.Msg)
+	if err != nil {
+		ss.fail("error", msg, err)
+		return true, nil
+	}
+	meta := starlark.NewDict(5)
+	_ = meta.SetKey(starlark.String("collection"), starlark.String(msg.Collection))
+	_ = meta.SetKey(starlark.String("private_id"), starlark.String(msg.PrivateID))
+	_ = meta.SetKey(starlark.String("source"), starlark.String(msg.Source))
+	_ = meta.SetKey(starlark.String("server_time"), starlark.String(msg.ServerTime.UTC().Format(time.RFC3339Nano)))
+	node := ""
+	if msg.Peer != nil {
+		node = msg.Peer.NodeName
+	}
+	_ = meta.SetKey(starlark.String("node"), starlark.String(node))
+	meta.Freeze()
+
+	inv := &invocation{}
+	thread := &starlark.Thread{Name: "process"}
+	thread.SetLocal("invocation", inv)
+	var timedOut atomic.Bool
+	if ss.Timeout > 0 {
+		timer := time.AfterFunc(ss.Timeout, func() {
+			timedOut.Store(true)
+			thread.Cancel("timeout")
+		})
+		defer timer.Stop()
+	}
+	res, err := starlark.Call(thread, ss.process, starlark.Tuple{entry, meta}, nil)
+	if err != nil {
+		if timedOut.Load() {
+			ss.fail("timeout", msg, err)
+		} else {
+			ss.fail("error", msg, err)
+		}
+		return true, nil
+	}
+
+	var derived []LogtailMsg
+	for _, d := range inv.derived {
+		dm := msg
+		dm.Msg = d
+		derived = append(derived, dm)
+	}
+	if res == starlark.None {
+		return false, derived
+	}
+	v, err := fromStarlark(res)
+	m, ok := v.(map[string]interface{})
+	if err != nil || !ok {
+		ss.fail("error", msg, errors.Errorf("process must return a dict or None, got %s", res.Type()))
+		return true, derived
+	}
+	// the caller holds on to the map
+	clear(msg.Msg)
+	maps.Copy(msg.Msg, m)
+	return true, derived
+}
+
+func (ss *ScriptService) fail(reason string, msg LogtailMsg, err error) {
+	ss.Errors.With(prometheus.Labels{"reason": reason}).Inc()
+	log.Warn().Err(err).Str("private_id", msg.PrivateID).Msg("Script failed, keeping entry unchanged")
+}
+
+// toStarlark converts a decoded JSON value.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case float64:
+		return starlark.Float(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case int64:
+		return starlark.MakeInt64(v), nil
+	case []string:
+		l := make([]starlark.Value, len(v))
+		for i, e := range v {
+			l[i] = starlark.String(e)
+		}
+		return starlark.NewList(l), nil
+	case []interface{}:
+		l := make([]starlark.Value, len(v))
+		for i, e := range v {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = sv
+		}
+		return starlark.NewList(l), nil
+	case map[string]interface{}:
+		d := starlark.NewDict(len(v))
+		for k, e := range v {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.SetKey(starlark.String(k), sv); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	default:
+		return nil, errors.Errorf("unsupported type %T", v)
+	}
+}
+
+// fromStarlark converts a value to a value that can be encoded as JSON.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		f, _ := starlark.AsFloat(v)
+		return f, nil
+	case starlark.Indexable:
+		// lists and tuples
+		l := make([]interface{}, v.Len())
+		for i := range v.Len() {
+			e, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			l[i] = e
+		}
+		return l, nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, errors.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			e, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)] = e
+		}
+		return m, nil
+	default:
+		return nil, errors.Errorf("unsupported type %s", v.Type())
+	}
+}
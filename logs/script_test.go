@@ -0,0 +1,110 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testScript = `
+def process(entry, meta):
+    text = entry.get("text", "")
+    if text.startswith("netcheck: "):
+        count("netcheck")
+        return None
+    if text.startswith("magicsock: derp"):
+        emit({"event": "derp_change", "node": meta["private_id"]})
+    if text == "loop":
+        for i in range(100000000):
+            pass
+    if text == "fail":
+        fail("failed")
+    entry["length"] = len(text)
+    return entry
+`
+
+func TestScriptProcess(t *testing.T) {
+	sc, err := NewScriptServiceFromSource("test.star", []byte(testScript), 50*time.Millisecond, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		in      map[string]interface{}
+		keep    bool
+		out     map[string]interface{}
+		derived []map[string]interface{}
+	}{
+		{
+			name: "modify",
+			in:   map[string]interface{}{"text": "hello", "logtail": map[string]interface{}{"proc_seq": 1.0}},
+			keep: true,
+			out:  map[string]interface{}{"text": "hello", "length": int64(5), "logtail": map[string]interface{}{"proc_seq": 1.0}},
+		},
+		{
+			name: "drop",
+			in:   map[string]interface{}{"text": "netcheck: report"},
+			keep: false,
+			out:  map[string]interface{}{"text": "netcheck: report"},
+		},
+		{
+			name:    "emit",
+			in:      map[string]interface{}{"text": "magicsock: derp-1 connected"},
+			keep:    true,
+			out:     map[string]interface{}{"text": "magicsock: derp-1 connected", "length": int64(27)},
+			derived: []map[string]interface{}{{"event": "derp_change", "node": "abc"}},
+		},
+		{
+			name: "timeout",
+			in:   map[string]interface{}{"text": "loop"},
+			keep: true,
+			out:  map[string]interface{}{"text": "loop"},
+		},
+		{
+			name: "error",
+			in:   map[string]interface{}{"text": "fail"},
+			keep: true,
+			out:  map[string]interface{}{"text": "fail"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := LogtailMsg{Msg: tc.in, PrivateID: "abc"}
+			keep, derived := sc.Process(msg)
+			if keep != tc.keep || !reflect.DeepEqual(msg.Msg, tc.out) {
+				t.Fatalf(`Process() = %t, %v, want %t, %v`, keep, msg.Msg, tc.keep, tc.out)
+			}
+			var got []map[string]interface{}
+			for _, d := range derived {
+				got = append(got, d.Msg)
+			}
+			if !reflect.DeepEqual(got, tc.derived) {
+				t.Fatalf(`derived = %v, want %v`, got, tc.derived)
+			}
+		})
+	}
+
+	if n := testutil.ToFloat64(sc.Counts.WithLabelValues("netcheck")); n != 1 {
+		t.Fatalf(`count("netcheck") = %f, want 1`, n)
+	}
+	if n := testutil.ToFloat64(sc.Errors.WithLabelValues("timeout")); n != 1 {
+		t.Fatalf(`timeouts = %f, want 1`, n)
+	}
+	if n := testutil.ToFloat64(sc.Errors.WithLabelValues("error")); n != 1 {
+		t.Fatalf(`errors = %f, want 1`, n)
+	}
+}
+
+func TestScriptInvalid(t *testing.T) {
+	for _, src := range []string{
+		"x = ",
+		"def other(entry, meta):\n    return entry\n",
+		"emit({})\ndef process(entry, meta):\n    return entry\n",
+	} {
+		if _, err := NewScriptServiceFromSource("test.star", []byte(src), 0, prometheus.NewRegistry()); err == nil {
+			t.Fatalf(`NewScriptServiceFromSource(%q) succeeded, want error`, src)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"sync"
+)
+
+// number of processes that are tracked per node. Every restart of tailscaled starts a new process,
+// the least recently seen processes are forgotten.
+const maxProcsPerNode = 8
+
+type procState struct {
+	// last seen proc_seq
+	seq uint64
+	// when the process was last seen, in calls of Process
+	seen uint64
+}
+
+// SequenceService tracks the logtail sequence numbers of each node's processes.
+// It detects entries that were lost in transit (gaps) and entries that were
+// uploaded more than once (duplicates), e.g. because a retried upload already succeeded.
+type SequenceService struct {
+	mu sync.Mutex
+	// private_id -> proc_id -> state
+	last       map[string]map[uint32]*procState
+	clock      uint64
+	Gaps       *prometheus.CounterVec
+	Duplicates *prometheus.CounterVec
+}
+
+func NewSequenceService(reg prometheus.Registerer) *SequenceService {
+	ss := &SequenceService{
+		last: map[string]map[uint32]*procState{},
+		Gaps: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_logtail_gap_entries_total",
+				Help: "Number of log entries that were never received, detected by gaps in the logtail sequence numbers.",
+			},
+			[]string{"private_id"}),
+		Duplicates: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_logtail_duplicate_entries_total",
+				Help: "Number of log entries that were received more than once and dropped.",
+			},
+			[]string{"private_id"}),
+	}
+	reg.MustRegister(ss.Gaps, ss.Duplicates)
+	return ss
+}
+
+// Process records the sequence number of the message.
+// It returns false if the message is a duplicate and should be dropped.
+func (ss *SequenceService) Process(msg LogtailMsg) bool {
+	b := ss.Batch()
+	keep := b.Process(msg)
+	b.Commit()
+	return keep
+}
+
+type procKey struct {
+	privateID string
+	procID    uint32
+}
+
+// SequenceBatch checks the sequence numbers of an upload against the state of the service.
+// The state and the counters are only updated when the batch is committed,
+// so that a rejected upload does not make its retry look like duplicates.
+type SequenceBatch struct {
+	ss *SequenceService
+	// processes in the order they were last seen in the batch
+	procs []procKey
+	seqs  map[procKey]uint64
+	gaps  map[string]uint64
+	dups  map[string]uint64
+}
+
+func (ss *SequenceService) Batch() *SequenceBatch {
+	return &SequenceBatch{
+		ss:   ss,
+		seqs: map[procKey]uint64{},
+		gaps: map[string]uint64{},
+		dups: map[string]uint64{},
+	}
+}
+
+// Process checks the sequence number of the message.
+// It returns false if the message is a duplicate and should be dropped.
+func (b *SequenceBatch) Process(msg LogtailMsg) bool {
+	meta, ok, err := msg.Meta()
+	if err != nil {
+		log.Warn().Err(err).Str("private_id", msg.PrivateID).Msg("Invalid logtail metadata")
+		return true
+	}
+	if !ok || meta.ProcSeq == 0 {
+		return true
+	}
+
+	k := procKey{msg.PrivateID, meta.ProcID}
+	last, ok := b.seqs[k]
+	if !ok {
+		b.ss.mu.Lock()
+		if p, found := b.ss.last[msg.PrivateID][meta.ProcID]; found {
+			last, ok = p.seq, true
+		}
+		b.ss.mu.Unlock()
+	}
+	b.procs = append(slices.DeleteFunc(b.procs, func(p procKey) bool { return p == k }), k)
+	if !ok {
+		// first entry of this process that we see, nothing to compare against
+		b.seqs[k] = meta.ProcSeq
+		return true
+	}
+
+	switch {
+	case meta.ProcSeq <= last:
+		log.Debug().Msgf("Dropping duplicate entry %d/%d of %s", meta.ProcID, meta.ProcSeq, msg.PrivateID)
+		b.seqs[k] = last
+		b.dups[msg.PrivateID]++
+		return false
+	case meta.ProcSeq > last+1:
+		missing := meta.ProcSeq - last - 1
+		log.Warn().Msgf("Missing %d entries (%d to %d) of process %d of %s", missing, last+1, meta.ProcSeq-1, meta.ProcID, msg.PrivateID)
+		b.gaps[msg.PrivateID] += missing
+	}
+	b.seqs[k] = meta.ProcSeq
+	return true
+}
+
+// Commit records the sequence numbers of the batch and counts its gaps and duplicates.
+func (b *SequenceBatch) Commit() {
+	b.ss.mu.Lock()
+	defer b.ss.mu.Unlock()
+	for _, k := range b.procs {
+		b.ss.clock++
+		procs, ok := b.ss.last[k.privateID]
+		if !ok {
+			procs = map[uint32]*procState{}
+			b.ss.last[k.privateID] = procs
+		}
+		p, ok := procs[k.procID]
+		if !ok {
+			if len(procs) >= maxProcsPerNode {
+				evictOldestProc(procs)
+			}
+			p = &procState{}
+			procs[k.procID] = p
+		}
+		// a concurrent upload of the node may have been committed in the meantime
+		p.seq = max(p.seq, b.seqs[k])
+		p.seen = b.ss.clock
+	}
+	for id, n := range b.gaps {
+		b.ss.Gaps.With(prometheus.Labels{"private_id": id}).Add(float64(n))
+	}
+	for id, n := range b.dups {
+		b.ss.Duplicates.With(prometheus.Labels{"private_id": id}).Add(float64(n))
+	}
+}
+
+func evictOldestProc(procs map[uint32]*procState) {
+	var oldest uint32
+	var seen uint64
+	for id, p := range procs {
+		if seen == 0 || p.seen < seen {
+			oldest, seen = id, p.seen
+		}
+	}
+	delete(procs, oldest)
+}
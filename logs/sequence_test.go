@@ -0,0 +1,109 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func seqMsg(procID, procSeq int) LogtailMsg {
+	return LogtailMsg{
+		Msg: map[string]interface{}{
+			"logtail": map[string]interface{}{
+				"client_time": "2024-12-21T12:00:00.123456789Z",
+				"proc_id":     float64(procID),
+				"proc_seq":    float64(procSeq),
+			},
+		},
+		PrivateID: "abc",
+	}
+}
+
+func TestSequenceProcess(t *testing.T) {
+	type seq struct {
+		proc int
+		seq  int
+	}
+	tests := []struct {
+		name string
+		in   []seq
+		keep []bool
+		gaps float64
+		dups float64
+	}{
+		{name: "in order", in: []seq{{1, 1}, {1, 2}, {1, 3}}, keep: []bool{true, true, true}},
+		{name: "gap", in: []seq{{1, 1}, {1, 4}, {1, 5}}, keep: []bool{true, true, true}, gaps: 2},
+		{name: "duplicate", in: []seq{{1, 1}, {1, 2}, {1, 2}, {1, 1}, {1, 3}}, keep: []bool{true, true, false, false, true}, dups: 2},
+		{name: "new process", in: []seq{{1, 5}, {2, 1}, {1, 6}, {2, 2}}, keep: []bool{true, true, true, true}},
+		{name: "first seen late", in: []seq{{1, 100}, {1, 101}}, keep: []bool{true, true}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := NewSequenceService(prometheus.NewRegistry())
+			for i, s := range tc.in {
+				if keep := ss.Process(seqMsg(s.proc, s.seq)); keep != tc.keep[i] {
+					t.Fatalf(`Process(%d/%d) = %t, want %t`, s.proc, s.seq, keep, tc.keep[i])
+				}
+			}
+			if gaps := testutil.ToFloat64(ss.Gaps.WithLabelValues("abc")); gaps != tc.gaps {
+				t.Fatalf(`gaps = %f, want %f`, gaps, tc.gaps)
+			}
+			if dups := testutil.ToFloat64(ss.Duplicates.WithLabelValues("abc")); dups != tc.dups {
+				t.Fatalf(`duplicates = %f, want %f`, dups, tc.dups)
+			}
+		})
+	}
+}
+
+func TestSequenceEvict(t *testing.T) {
+	ss := NewSequenceService(prometheus.NewRegistry())
+	ss.Process(seqMsg(1, 1))
+	// restarts of the node
+	for proc := 2; proc <= maxProcsPerNode*2; proc++ {
+		ss.Process(seqMsg(proc, 1))
+		// process 1 is still running
+		ss.Process(seqMsg(1, proc))
+	}
+	if n := len(ss.last["abc"]); n != maxProcsPerNode {
+		t.Fatalf(`%d tracked processes, want %d`, n, maxProcsPerNode)
+	}
+	if _, ok := ss.last["abc"][1]; !ok {
+		t.Fatal(`recently seen process was evicted`)
+	}
+	if keep := ss.Process(seqMsg(1, maxProcsPerNode*2)); keep {
+		t.Fatal(`duplicate of a recently seen process was kept`)
+	}
+}
+
+func TestSequenceBatch(t *testing.T) {
+	ss := NewSequenceService(prometheus.NewRegistry())
+	process := func(b *SequenceBatch, seqs ...int) {
+		t.Helper()
+		for _, s := range seqs {
+			if !b.Process(seqMsg(1, s)) {
+				t.Fatalf(`Process(1/%d) = false, want true`, s)
+			}
+		}
+	}
+	// a rejected upload is not committed, its retry is not a duplicate
+	process(ss.Batch(), 1, 2, 3)
+	b := ss.Batch()
+	process(b, 1, 2, 3)
+	b.Commit()
+	if dups := testutil.ToFloat64(ss.Duplicates.WithLabelValues("abc")); dups != 0 {
+		t.Fatalf(`dups = %f, want 0`, dups)
+	}
+	b = ss.Batch()
+	if b.Process(seqMsg(1, 3)) {
+		t.Fatal(`duplicate of a committed batch was kept`)
+	}
+	process(b, 5)
+	b.Commit()
+	if gaps := testutil.ToFloat64(ss.Gaps.WithLabelValues("abc")); gaps != 1 {
+		t.Fatalf(`gaps = %f, want 1`, gaps)
+	}
+	if dups := testutil.ToFloat64(ss.Duplicates.WithLabelValues("abc")); dups != 1 {
+		t.Fatalf(`dups = %f, want 1`, dups)
+	}
+}
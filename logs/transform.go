@@ -0,0 +1,154 @@
+package logs
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"github.com/qup42/loghead/types"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// tailscaled prefixes its log lines with the subsystem, e.g. "magicsock: ", and verbose lines with "[v1] "
+var (
+	textLevelRe     = regexp.MustCompile(`^\[(v[0-9]|unexpected|RATELIMIT)\] `)
+	textSubsystemRe = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9_.-]{0,31}(?:\{[^}]*\})?(?:\[[0-9]+\])?): `)
+)
+
+var textLevels = map[string]string{
+	"v1":         "debug",
+	"v2":         "trace",
+	"unexpected": "warn",
+	"RATELIMIT":  "info",
+}
+
+// ParseText splits a tailscaled log line into level, subsystem and message.
+// The subsystem is empty if the line has no prefix.
+func ParseText(text string) (level, subsystem, message string) {
+	message = strings.TrimRight(text, "\n")
+	level = "info"
+	if m := textLevelRe.FindStringSubmatch(message); m != nil {
+		if l, ok := textLevels[m[1]]; ok {
+			level = l
+		} else {
+			level = "debug"
+		}
+		message = message[len(m[0]):]
+	}
+	if m := textSubsystemRe.FindStringSubmatch(message); m != nil {
+		subsystem = m[1]
+		message = message[len(m[0]):]
+	}
+	return level, subsystem, message
+}
+
+// TransformService restructures entries so that all outputs receive records of the same shape.
+// The steps are applied in this order: parse text, attach inventory, add static fields, rename and remove fields.
+type TransformService struct {
+	ParseText bool
+	Inventory bool
+	Rename    [][2][]string
+	Remove    [][]string
+	Fields    map[string]string
+
+	// latest Hostinfo of each node, by private id
+	hostinfo sync.Map
+}
+
+func NewTransformService(c types.TransformConfig) *TransformService {
+	ts := &TransformService{
+		ParseText: c.ParseText,
+		Inventory: c.Inventory,
+		Fields:    map[string]string{},
+	}
+	for _, r := range c.Rename {
+		ts.Rename = append(ts.Rename, [2][]string{strings.Split(r.From, "."), strings.Split(r.To, ".")})
+	}
+	for _, f := range c.Remove {
+		ts.Remove = append(ts.Remove, strings.Split(f, "."))
+	}
+	for _, f := range c.Fields {
+		ts.Fields[f.Name] = f.Value
+	}
+	return ts
+}
+
+// removeField removes the value at the dotted path and returns it.
+func removeField(m map[string]interface{}, path []string) (interface{}, bool) {
+	for _, k := range path[:len(path)-1] {
+		mm, ok := m[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		m = mm
+	}
+	v, ok := m[path[len(path)-1]]
+	delete(m, path[len(path)-1])
+	return v, ok
+}
+
+// setField sets the value at the dotted path, creating intermediate objects.
+func setField(m map[string]interface{}, path []string, v interface{}) {
+	for _, k := range path[:len(path)-1] {
+		mm, ok := m[k].(map[string]interface{})
+		if !ok {
+			mm = map[string]interface{}{}
+			m[k] = mm
+		}
+		m = mm
+	}
+	m[path[len(path)-1]] = v
+}
+
+func (ts *TransformService) inventory(msg LogtailMsg) map[string]interface{} {
+	if h, ok := msg.Msg["Hostinfo"]; ok {
+		var hi HostInfo
+		if err := mapstructure.Decode(h, &hi); err == nil {
+			ts.hostinfo.Store(msg.PrivateID, hi)
+		}
+	}
+	node := map[string]interface{}{}
+	if v, ok := ts.hostinfo.Load(msg.PrivateID); ok {
+		hi := v.(HostInfo)
+		node["hostname"] = hi.Hostname
+		node["os"] = hi.OS
+		node["os_version"] = hi.OSVersion
+		node["version"] = hi.IPNVersion
+	}
+	if msg.Peer != nil {
+		node["name"] = msg.Peer.NodeName
+		node["id"] = msg.Peer.NodeID
+		node["user"] = msg.Peer.User
+		node["tags"] = msg.Peer.Tags
+	}
+	return node
+}
+
+// Process transforms the entry in place.
+func (ts *TransformService) Process(msg LogtailMsg) {
+	if ts.ParseText {
+		if text, ok := msg.Msg["text"].(string); ok {
+			level, subsystem, message := ParseText(text)
+			msg.Msg["level"] = level
+			if subsystem != "" {
+				msg.Msg["subsystem"] = subsystem
+			}
+			msg.Msg["message"] = message
+		}
+	}
+	if ts.Inventory {
+		if node := ts.inventory(msg); len(node) > 0 {
+			msg.Msg["node"] = node
+		}
+	}
+	for k, v := range ts.Fields {
+		msg.Msg[k] = v
+	}
+	for _, r := range ts.Rename {
+		if v, ok := removeField(msg.Msg, r[0]); ok {
+			setField(msg.Msg, r[1], v)
+		}
+	}
+	for _, f := range ts.Remove {
+		removeField(msg.Msg, f)
+	}
+}
@@ -0,0 +1,73 @@
+package logs
+
+import (
+	"github.com/qup42/loghead/types"
+	"reflect"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		text      string
+		level     string
+		subsystem string
+		message   string
+	}{
+		{text: "magicsock: endpoints changed: 1.2.3.4:41641\n", level: "info", subsystem: "magicsock", message: "endpoints changed: 1.2.3.4:41641"},
+		{text: "[v1] netcheck: report: udp=true", level: "debug", subsystem: "netcheck", message: "report: udp=true"},
+		{text: "[unexpected] magicsock: no DERP region", level: "warn", subsystem: "magicsock", message: "no DERP region"},
+		{text: "wg: [v2] sending keepalive", level: "info", subsystem: "wg", message: "[v2] sending keepalive"},
+		{text: "peerapi: serving on http://100.64.0.1:1234", level: "info", subsystem: "peerapi", message: "serving on http://100.64.0.1:1234"},
+		{text: "Program starting: v1.82.5", level: "info", subsystem: "", message: "Program starting: v1.82.5"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.text, func(t *testing.T) {
+			level, subsystem, message := ParseText(tc.text)
+			if level != tc.level || subsystem != tc.subsystem || message != tc.message {
+				t.Fatalf(`ParseText(%q) = %q, %q, %q, want %q, %q, %q`, tc.text, level, subsystem, message, tc.level, tc.subsystem, tc.message)
+			}
+		})
+	}
+}
+
+func TestTransformProcess(t *testing.T) {
+	ts := NewTransformService(types.TransformConfig{
+		ParseText: true,
+		Inventory: true,
+		Rename:    []types.FieldRenameConfig{{From: "message", To: "msg"}, {From: "logtail.client_time", To: "time"}},
+		Remove:    []string{"text", "logtail"},
+		Fields:    []types.StaticFieldConfig{{Name: "environment", Value: "prod"}},
+	})
+	peer := &types.PeerIdentity{NodeName: "node1.example.ts.net", NodeID: "n1", User: "user@example.com", Tags: []string{"tag:server"}}
+
+	// the inventory remembers the last Hostinfo of the node
+	ts.Process(LogtailMsg{PrivateID: "abc", Msg: map[string]interface{}{
+		"Hostinfo": map[string]interface{}{"OS": "linux", "Hostname": "node1", "IPNVersion": "1.82.5"},
+	}})
+
+	msg := LogtailMsg{PrivateID: "abc", Peer: peer, Msg: map[string]interface{}{
+		"text":    "magicsock: endpoints changed\n",
+		"logtail": map[string]interface{}{"client_time": "2025-01-01T00:00:00Z"},
+	}}
+	ts.Process(msg)
+	want := map[string]interface{}{
+		"level":       "info",
+		"subsystem":   "magicsock",
+		"msg":         "endpoints changed",
+		"time":        "2025-01-01T00:00:00Z",
+		"environment": "prod",
+		"node": map[string]interface{}{
+			"hostname":   "node1",
+			"os":         "linux",
+			"os_version": "",
+			"version":    "1.82.5",
+			"name":       "node1.example.ts.net",
+			"id":         "n1",
+			"user":       "user@example.com",
+			"tags":       []string{"tag:server"},
+		},
+	}
+	if !reflect.DeepEqual(msg.Msg, want) {
+		t.Fatalf(`Process() = %v, want %v`, msg.Msg, want)
+	}
+}
@@ -1,9 +1,52 @@
 package logs
 
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/mitchellh/mapstructure"
+	"github.com/qup42/loghead/types"
+	"time"
+)
+
 type LogtailMsg struct {
 	Msg        map[string]interface{}
 	Collection string
 	PrivateID  string
+	// ServerTime is the time the message was received
+	ServerTime time.Time
+	// Source is the remote address of the uploader
+	// or the name of the uploading node if the listener is a tsnet listener
+	Source string
+	// Peer is the tailnet identity of the uploading node.
+	// It is nil unless the listener is a tsnet listener.
+	Peer *types.PeerIdentity
+}
+
+// LogtailMeta is the metadata logtail attaches to each entry under the `logtail` key.
+// See https://github.com/tailscale/tailscale/blob/main/logtail/api.md#structured-logging
+type LogtailMeta struct {
+	ClientTime time.Time `mapstructure:"client_time"`
+	ProcID     uint32    `mapstructure:"proc_id"`
+	ProcSeq    uint64    `mapstructure:"proc_seq"`
+}
+
+// Meta returns the logtail metadata of the message. ok is false if the message has none.
+func (m LogtailMsg) Meta() (meta LogtailMeta, ok bool, err error) {
+	raw, ok := m.Msg["logtail"]
+	if !ok {
+		return meta, false, nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339Nano),
+		Result:     &meta,
+	})
+	if err != nil {
+		return meta, false, errors.Errorf("creating decoder: %w", err)
+	}
+	err = decoder.Decode(raw)
+	if err != nil {
+		return meta, false, errors.Errorf("unmarshaling logtail metadata: %w", err)
+	}
+	return meta, true, nil
 }
 
 type MsgProcessor func(LogtailMsg)
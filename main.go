@@ -4,8 +4,11 @@ import (
 	"context"
 	"github.com/efekarakus/termcolor"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/limits"
 	"github.com/qup42/loghead/logs"
 	"github.com/qup42/loghead/node_metrics"
+	"github.com/qup42/loghead/policy"
 	"github.com/qup42/loghead/ssh"
 	"github.com/qup42/loghead/types"
 	"github.com/rs/zerolog"
@@ -15,6 +18,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 )
 
@@ -48,12 +52,18 @@ func SetupLogging() {
 	}).With().Caller().Logger()
 }
 
-func serve(ctx context.Context, r *mux.Router, ln net.Listener) error {
+// serve serves r on ln. If h2c is set, unencrypted HTTP/2 is accepted in addition to HTTP/1.
+func serve(ctx context.Context, r *mux.Router, ln net.Listener, h2c bool) error {
 	s := http.Server{
 		Handler:      r,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
+	if h2c {
+		s.Protocols = new(http.Protocols)
+		s.Protocols.SetHTTP1(true)
+		s.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	serveErr := make(chan error, 1)
 	go func() {
@@ -83,26 +93,116 @@ func main() {
 
 	log.Debug().Msgf("Config: %+v", c)
 
+	if len(os.Args) > 1 {
+		err = runCommand(c, os.Args[1:])
+		if err != nil {
+			log.Fatal().Err(err).Msg("Command failed")
+		}
+		return
+	}
+
 	var fls *logs.FileLoggerService
 	var fwd *logs.ForwardingService
 	var hs *logs.HostInfoService
 	var ms *logs.MetricsService
+	var ss *logs.SequenceService
+	var fs *logs.FilterService
+	var as *logs.AnnotationService
+	var ts *logs.TransformService
+	var sc *logs.ScriptService
+	var ep *logs.ExternalProcessorService
+	var dl *logs.DeadLetterService
 	var rs *ssh.RecordingService
+	redactors := map[string]*logs.Redactor{}
+	for name, rc := range c.Loghead.Redaction {
+		redactors[name], err = logs.NewRedactor(name, rc)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create redaction profile")
+		}
+	}
+	getRedactor := func(name string) *logs.Redactor {
+		if name == "" {
+			return nil
+		}
+		// viper lower cases the profile names
+		r, ok := redactors[strings.ToLower(name)]
+		if !ok {
+			log.Fatal().Msgf("Unknown redaction profile %s", name)
+		}
+		return r
+	}
 	if c.Loghead.Processors.FileLogger.Enabled {
 		fls, err = logs.NewFileLoggerService(c.Loghead.Processors.FileLogger)
 		if err != nil {
-			log.Fatal().Err(err)
+			log.Fatal().Err(err).Msg("Could not create FileLogger")
 		}
+		fls.Redactor = getRedactor(c.Loghead.Processors.FileLogger.Redact)
+		defer func() {
+			if err := fls.Close(); err != nil {
+				log.Error().Err(err).Msg("Closing FileLogger")
+			}
+		}()
 	}
+	// loghead's own metrics are served at /metrics of the client logs listener, together with the client metrics
+	reg := prometheus.NewRegistry()
 	if c.Loghead.Processors.Metrics {
-		ms = logs.NewMetricsService()
+		ms = logs.NewMetricsService(reg)
+	}
+	if c.Loghead.Processors.Sequence {
+		ss = logs.NewSequenceService(reg)
+	}
+	if len(c.Loghead.Filters) > 0 {
+		fs, err = logs.NewFilterService(c.Loghead.Filters, reg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create filters")
+		}
+	}
+	if c.Loghead.Processors.Annotate {
+		as = logs.NewAnnotationService(reg)
+	}
+	if c.Loghead.Transform.Enabled {
+		ts = logs.NewTransformService(c.Loghead.Transform)
+	}
+	if c.Loghead.Script.Enabled {
+		sc, err = logs.NewScriptService(c.Loghead.Script, reg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not load script")
+		}
+	}
+	if c.Loghead.Processors.External.Enabled {
+		ep, err = logs.NewExternalProcessorService(c.Loghead.Processors.External, reg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create external processor")
+		}
+		ep.Collections = c.Loghead.Collections
+		if fls != nil {
+			ep.Sink = func(msgs []logs.LogtailMsg) {
+				if err := fls.LogBatch(msgs); err != nil {
+					log.Error().Err(err).Msg("Writing records of the external processor")
+				}
+			}
+		}
+		ep.Start()
+		defer ep.Close()
+	}
+	if c.Loghead.DeadLetter.Enabled {
+		dl, err = logs.NewDeadLetterService(c.Loghead.DeadLetter)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create dead letter store")
+		}
 	}
 	if c.Loghead.Processors.Hostinfo {
-		hs = &logs.HostInfoService{}
+		hs = logs.NewHostInfoService(reg)
 	}
 	if c.Loghead.Processors.Forward.Enabled {
 		log.Info().Msgf("Enableing forwarder to %s", c.Loghead.Processors.Forward.Addr)
 		fwd = logs.NewForwardingService(c.Loghead.Processors.Forward.Addr)
+		fwd.Redactor = getRedactor(c.Loghead.Processors.Forward.Redact)
+	}
+	rl := limits.NewRateLimitService(c.Loghead.Limits, reg)
+	ps, err := policy.NewPolicyService(c.Policy, reg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not create policy")
 	}
 	rs, err = ssh.NewRecordingService(c.SSHRecorder)
 	if err != nil {
@@ -120,43 +220,65 @@ func main() {
 	g, ctx := errgroup.WithContext(ctx)
 
 	// logtail
-	ltr := mux.NewRouter()
-	addClientLogsRoutes(ltr, c, fwd, fls, hs, ms)
-
 	logheadListener, err := types.MakeListener(ctx, c.Loghead.Listener, "loghead")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Creating loghead listener")
 	}
 	defer logheadListener.Close()
+
+	if dl != nil && c.Loghead.DeadLetter.API && !c.Policy.DeadLetter.Enabled {
+		log.Warn().Msg("The dead letter API is enabled without a deadletter policy, all requests to it are denied")
+	}
+	ltr := newClientLogsRouter(logheadListener, c, pipeline{
+		Limits:     c.Loghead.Limits,
+		Forward:    fwd,
+		FileLogger: fls,
+		Hostinfo:   hs,
+		Metrics:    ms,
+		Sequence:   ss,
+		Filters:    fs,
+		Annotate:   as,
+		Transform:  ts,
+		Script:     sc,
+		External:   ep,
+		DeadLetter: dl,
+		Redactor:   getRedactor(c.Loghead.Redact),
+		Policy:     ps,
+	}, rl, reg)
 	g.Go(func() error {
-		return serve(ctx, ltr, logheadListener.Listener)
+		return serve(ctx, ltr, logheadListener.Listener, false)
 	})
 
 	// SSH session recording
-	sr := mux.NewRouter()
-	addSSHRecordingRoutes(sr, rs)
-
 	sshListener, err := types.MakeListener(ctx, c.SSHRecorder.Listener, "SSHRecorder")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Creating SSHRecorder listener")
 	}
 	defer sshListener.Close()
+
+	if c.SSHRecorder.API && !c.Policy.Recordings.Enabled {
+		log.Warn().Msg("The recordings API is enabled without a recordings policy, all requests to it are denied")
+	}
+	sr := newSSHRecorderRouter(sshListener, c, ps, rs)
 	g.Go(func() error {
-		return serve(ctx, sr, sshListener.Listener)
+		// the v2 recording protocol uses HTTP/2 without TLS
+		return serve(ctx, sr, sshListener.Listener, true)
 	})
 
 	// Node metrics
 	if c.NodeMetrics.Enabled {
-		nm := mux.NewRouter()
-		addNodeMetricsRoutes(nm, c, nms)
-
 		nodeMetricsListener, err := types.MakeListener(ctx, c.NodeMetrics.Listener, "NodeMetrics")
 		if err != nil {
 			log.Fatal().Err(err).Msg("Creating NodeMetrics listener")
 		}
 		defer nodeMetricsListener.Close()
+
+		nm := mux.NewRouter()
+		nm.Use(identifyPeer(nodeMetricsListener, c.NodeMetrics.Listener.TS.RequireKnownPeer))
+		nm.Use(enforcePolicy(ps, policy.NodeMetrics))
+		addNodeMetricsRoutes(nm, c, nms)
 		g.Go(func() error {
-			return serve(ctx, nm, nodeMetricsListener.Listener)
+			return serve(ctx, nm, nodeMetricsListener.Listener, false)
 		})
 	}
 
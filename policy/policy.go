@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+const (
+	ClientLogs    = "client_logs"
+	SSHRecordings = "ssh_recordings"
+	NodeMetrics   = "node_metrics"
+	DeadLetter    = "deadletter"
+	Recordings    = "recordings"
+)
+
+// these services expose data of all nodes and are denied to everyone unless a rule allows them
+var denyByDefault = []string{Recordings, DeadLetter}
+
+type Rule struct {
+	Tags     []string
+	Users    []string
+	Prefixes []netip.Prefix
+}
+
+// PolicyService decides which clients may use which service.
+// Services without a rule are available to everyone, except for the ones in denyByDefault.
+type PolicyService struct {
+	Rules  map[string]*Rule
+	Denied *prometheus.CounterVec
+}
+
+func newRule(c types.PolicyRuleConfig) (*Rule, error) {
+	r := &Rule{
+		Tags:  c.Tags,
+		Users: c.Users,
+	}
+	for _, cidr := range c.CIDRs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, errors.Errorf("invalid cidr \"%s\": %w", cidr, err)
+		}
+		r.Prefixes = append(r.Prefixes, p.Masked())
+	}
+	return r, nil
+}
+
+func NewPolicyService(c types.PolicyConfig, reg prometheus.Registerer) (*PolicyService, error) {
+	ps := &PolicyService{
+		Rules: map[string]*Rule{},
+		Denied: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loghead_policy_denied_requests_total",
+				Help: "Number of requests denied by the policy.",
+			},
+			[]string{"service"}),
+	}
+	for service, rc := range map[string]types.PolicyRuleConfig{
+		ClientLogs:    c.ClientLogs,
+		SSHRecordings: c.SSHRecordings,
+		NodeMetrics:   c.NodeMetrics,
+		DeadLetter:    c.DeadLetter,
+		Recordings:    c.Recordings,
+	} {
+		if !rc.Enabled {
+			continue
+		}
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, errors.Errorf("policy for %s: %w", service, err)
+		}
+		ps.Rules[service] = r
+	}
+	reg.MustRegister(ps.Denied)
+	return ps, nil
+}
+
+// Allowed reports whether the peer may use the service.
+// peer is nil if the client could not be identified, e.g. on plain listeners.
+func (r *Rule) Allowed(remoteAddr string, peer *types.PeerIdentity) bool {
+	if peer != nil {
+		if slices.Contains(r.Users, peer.User) {
+			return true
+		}
+		for _, t := range peer.Tags {
+			if slices.Contains(r.Tags, t) {
+				return true
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range r.Prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the peer may use the service and counts denied requests.
+func (ps *PolicyService) Allowed(service string, remoteAddr string, peer *types.PeerIdentity) bool {
+	r, ok := ps.Rules[service]
+	if !ok && !slices.Contains(denyByDefault, service) {
+		return true
+	}
+	if ok && r.Allowed(remoteAddr, peer) {
+		return true
+	}
+	ps.Denied.With(prometheus.Labels{"service": service}).Inc()
+	return false
+}
@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qup42/loghead/types"
+	"testing"
+)
+
+func TestRuleAllowed(t *testing.T) {
+	rule, err := newRule(types.PolicyRuleConfig{
+		Enabled: true,
+		Tags:    []string{"tag:server"},
+		Users:   []string{"alice@example.com"},
+		CIDRs:   []string{"10.0.0.0/8", "fd7a:115c:a1e0::/48"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		peer       *types.PeerIdentity
+		out        bool
+	}{
+		{name: "tagged", remoteAddr: "100.64.0.1:1234", peer: &types.PeerIdentity{Tags: []string{"tag:other", "tag:server"}}, out: true},
+		{name: "user", remoteAddr: "100.64.0.1:1234", peer: &types.PeerIdentity{User: "alice@example.com"}, out: true},
+		{name: "unknown user", remoteAddr: "100.64.0.1:1234", peer: &types.PeerIdentity{User: "bob@example.com"}, out: false},
+		{name: "cidr", remoteAddr: "10.1.2.3:1234", out: true},
+		{name: "cidr ipv6", remoteAddr: "[fd7a:115c:a1e0::1]:1234", out: true},
+		{name: "cidr mapped ipv4", remoteAddr: "[::ffff:10.1.2.3]:1234", out: true},
+		{name: "outside cidr", remoteAddr: "192.168.0.1:1234", out: false},
+		{name: "invalid address", remoteAddr: "foo", out: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if out := rule.Allowed(tc.remoteAddr, tc.peer); out != tc.out {
+				t.Fatalf(`Allowed("%s", %+v) = %t, want %t`, tc.remoteAddr, tc.peer, out, tc.out)
+			}
+		})
+	}
+}
+
+func TestPolicyServiceAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       types.PolicyConfig
+		service string
+		out     bool
+	}{
+		{name: "no rule", service: ClientLogs, out: true},
+		{name: "recordings without rule", service: Recordings, out: false},
+		{name: "recordings", c: types.PolicyConfig{Recordings: types.PolicyRuleConfig{Enabled: true, Tags: []string{"tag:admin"}}}, service: Recordings, out: true},
+		{name: "deadletter without rule", service: DeadLetter, out: false},
+		{name: "deadletter", c: types.PolicyConfig{DeadLetter: types.PolicyRuleConfig{Enabled: true, Tags: []string{"tag:admin"}}}, service: DeadLetter, out: true},
+		{name: "recordings other tag", c: types.PolicyConfig{Recordings: types.PolicyRuleConfig{Enabled: true, Tags: []string{"tag:other"}}}, service: Recordings, out: false},
+	}
+	peer := &types.PeerIdentity{Tags: []string{"tag:admin"}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ps, err := NewPolicyService(tc.c, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := ps.Allowed(tc.service, "100.64.0.1:1234", peer); out != tc.out {
+				t.Fatalf(`Allowed("%s") = %t, want %t`, tc.service, out, tc.out)
+			}
+		})
+	}
+}
@@ -1,24 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"github.com/cockroachdb/errors"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/qup42/loghead/limits"
 	"github.com/qup42/loghead/logs"
 	"github.com/qup42/loghead/node_metrics"
+	"github.com/qup42/loghead/policy"
 	"github.com/qup42/loghead/ssh"
 	"github.com/qup42/loghead/types"
 	"github.com/qup42/loghead/util"
 	"github.com/rs/zerolog/log"
 	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type FailableHandler func(http.ResponseWriter, *http.Request) error
 
+// HTTPError is an error that is caused by the request.
+// It is answered with its status code instead of 500.
+type HTTPError struct {
+	Code int
+	Err  error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
 func (fn FailableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			log.Warn().Err(err).Str("path", r.RequestURI).Msg("HTTP Request error")
+			http.Error(w, err.Error(), httpErr.Code)
+			return
+		}
 		log.Error().Err(err).Str("path", r.RequestURI).Msg("HTTP Request error")
 		http.Error(w, err.Error(), 500)
 	}
@@ -28,21 +62,55 @@ func addSSHRecordingRoutes(
 	r *mux.Router,
 	rs *ssh.RecordingService) {
 	r.Handle("/record", handleSSHRecording(rs))
+	r.Handle("/v2/record", handleSSHRecordingV2(rs)).Methods(http.MethodHead, http.MethodPost)
 	r.NotFoundHandler = handleNotFound()
 }
 
+// newSSHRecorderRouter serves the SSH recorder listener.
+// The recordings API is subject to the recordings policy only, not to the policy of the recorder.
+func newSSHRecorderRouter(ln *types.Listener, c *types.Config, ps *policy.PolicyService, rs *ssh.RecordingService) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(identifyPeer(ln, c.SSHRecorder.Listener.TS.RequireKnownPeer))
+	if c.SSHRecorder.API {
+		rr := r.PathPrefix("/recordings").Subrouter()
+		rr.Use(enforcePolicy(ps, policy.Recordings))
+		addRecordingsRoutes(rr, rs)
+	}
+	sr := r.NewRoute().Subrouter()
+	sr.Use(enforcePolicy(ps, policy.SSHRecordings))
+	addSSHRecordingRoutes(sr, rs)
+	r.NotFoundHandler = handleNotFound()
+	return r
+}
+
+// newClientLogsRouter serves the client logs listener.
+// The dead letter API is subject to the deadletter policy only, not to the policy of the uploads.
+// reg holds loghead's own metrics and the client metrics, it is served at /metrics.
+func newClientLogsRouter(ln *types.Listener, c *types.Config, p pipeline, rl *limits.RateLimitService, reg *prometheus.Registry) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(identifyPeer(ln, c.Loghead.Listener.TS.RequireKnownPeer))
+	if p.DeadLetter != nil && c.Loghead.DeadLetter.API {
+		dlr := r.PathPrefix("/deadletter").Subrouter()
+		dlr.Use(enforcePolicy(p.Policy, policy.DeadLetter))
+		addDeadLetterRoutes(dlr, p.DeadLetter)
+	}
+	lr := r.NewRoute().Subrouter()
+	lr.Use(enforcePolicy(p.Policy, policy.ClientLogs))
+	addClientLogsRoutes(lr, c, p, rl, reg)
+	r.NotFoundHandler = handleNotFound()
+	return r
+}
+
 func addClientLogsRoutes(
 	r *mux.Router,
 	c *types.Config,
-	fwd *logs.ForwardingService,
-	fl *logs.FileLoggerService,
-	hi *logs.HostInfoService,
-	ms *logs.MetricsService) {
+	p pipeline,
+	rl *limits.RateLimitService,
+	reg *prometheus.Registry) {
 
-	r.Handle("/c/{collection:[a-zA-Z0-9-_.]+}/{private_id:[0-9a-f]+}", handleTailnodeLogs(fwd, fl, hi, ms)).Methods(http.MethodPost)
-	if c.Loghead.Processors.Metrics {
-		r.Handle("/metrics", handleMetrics(ms))
-	}
+	r.Use(limitInFlight(rl))
+	r.Handle("/c/{collection:[a-zA-Z0-9-_.]+}/{private_id:[0-9a-f]+}", allowCollections(c.Loghead.Collections, rateLimit(rl, handleTailnodeLogs(p)))).Methods(http.MethodPost)
+	r.Handle("/metrics", handleMetrics(reg))
 	r.NotFoundHandler = handleNotFound()
 }
 
@@ -56,6 +124,92 @@ func addNodeMetricsRoutes(
 	r.NotFoundHandler = handleNotFound()
 }
 
+// identifyPeer resolves the tailnet identity of the client if the listener is a tsnet listener.
+// The identity is available to the handlers via types.PeerIdentityFromContext.
+// If requireKnown is set, requests from peers that cannot be identified are rejected.
+func identifyPeer(ln *types.Listener, requireKnown bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := ln.WhoIs(r.Context(), r.RemoteAddr)
+			if err != nil {
+				log.Warn().Err(err).Str("path", r.RequestURI).Msg("Could not identify peer")
+				if requireKnown {
+					http.Error(w, "unknown peer", http.StatusForbidden)
+					return
+				}
+			} else if p != nil {
+				log.Trace().Str("path", r.RequestURI).Msgf("Request from %s (%s)", p.NodeName, p.NodeID)
+				r = r.WithContext(types.WithPeerIdentity(r.Context(), p))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// enforcePolicy rejects requests of clients that may not use the service.
+func enforcePolicy(ps *policy.PolicyService, service string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := types.PeerIdentityFromContext(r.Context())
+			if !ps.Allowed(service, r.RemoteAddr, peer) {
+				l := log.Warn().Str("path", r.RequestURI).Str("service", service).Str("remote_addr", r.RemoteAddr)
+				if peer != nil {
+					l = l.Str("node", peer.NodeName).Str("user", peer.User).Strs("tags", peer.Tags)
+				}
+				l.Msg("Request denied by policy")
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// limitInFlight rejects requests while too many requests are being processed.
+func limitInFlight(rl *limits.RateLimitService) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !rl.Acquire() {
+				log.Warn().Str("path", r.RequestURI).Msg("Too many requests in flight")
+				setRetryAfter(w, time.Second)
+				http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+				return
+			}
+			defer rl.Release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowCollections answers uploads to collections that are not accepted with 404.
+func allowCollections(collections []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(collections, mux.Vars(r)["collection"]) {
+			handleNotFound().ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit rejects uploads of nodes that exceed their rate limit or if the global rate limit is exceeded.
+func rateLimit(rl *limits.RateLimitService, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		private_id := mux.Vars(r)["private_id"]
+		if ok, retryAfter := rl.Allow(private_id); !ok {
+			log.Debug().Str("path", r.RequestURI).Msgf("Throttling %s for %s", private_id, retryAfter)
+			setRetryAfter(w, retryAfter)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func handleSSHRecording(rec *ssh.RecordingService) http.Handler {
 	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
 		log.Trace().Msg("Starting SSH Session recording")
@@ -65,7 +219,7 @@ func handleSSHRecording(rec *ssh.RecordingService) http.Handler {
 		if err != nil {
 			return errors.Errorf("setting read deadline: %w", err)
 		}
-		err = rec.Record(r.Body)
+		err = rec.Record(r.Body, types.PeerIdentityFromContext(r.Context()))
 		if err != nil {
 			return errors.Errorf("recording sesion: %w", err)
 		}
@@ -74,53 +228,554 @@ func handleSSHRecording(rec *ssh.RecordingService) http.Handler {
 	})
 }
 
-func handleTailnodeLogs(
-	fwd *logs.ForwardingService,
-	fl *logs.FileLoggerService,
-	hi *logs.HostInfoService,
-	ms *logs.MetricsService) http.Handler {
+// interval in which v2 recordings are synced to disk and acknowledged,
+// clients stop the session if they do not receive an ack for 30s
+const recordingAckInterval = time.Second
+
+// recordingFrame is a frame of the response of the v2 recording protocol.
+type recordingFrame struct {
+	// bytes of the recording that were received and durably written
+	Ack int64 `json:"ack,omitempty"`
+	// the recording failed, only sent as the last frame
+	Error string `json:"error,omitempty"`
+}
+
+// handleSSHRecordingV2 implements the v2 protocol of the Tailscale session recorder.
+// The recording is uploaded in the request body over HTTP/2, while the response streams acks of the bytes that are on disk.
+func handleSSHRecordingV2(rec *ssh.RecordingService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// clients probe with HEAD whether the v2 protocol is supported
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		log.Trace().Msg("Starting SSH Session recording (v2)")
+		rc := http.NewResponseController(w)
+		// this is a streaming request, disable the deadlines
+		err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{}))
+		if err != nil {
+			log.Error().Err(err).Str("path", r.RequestURI).Msg("HTTP Request error")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		// HTTP/2 is always full duplex
+		if r.ProtoMajor == 1 {
+			_ = rc.EnableFullDuplex()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		// the client starts the upload once it receives the response
+		_ = rc.Flush()
+
+		enc := json.NewEncoder(w)
+		send := func(f recordingFrame) error {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		err = rec.RecordWithAcks(r.Body, types.PeerIdentityFromContext(r.Context()), recordingAckInterval, func(n int64) error {
+			return send(recordingFrame{Ack: n})
+		})
+		if err != nil {
+			log.Error().Err(err).Str("path", r.RequestURI).Msg("Recording SSH session")
+			_ = send(recordingFrame{Error: err.Error()})
+			return
+		}
+		log.Trace().Msg("SSH Session recording finished")
+	})
+}
+
+func addRecordingsRoutes(
+	r *mux.Router,
+	rs *ssh.RecordingService) {
+	r.Handle("", handleListRecordings(rs)).Methods(http.MethodGet)
+	r.Handle("/", handleListRecordings(rs)).Methods(http.MethodGet)
+	r.Handle("/verify", handleVerifyRecordings(rs)).Methods(http.MethodGet)
+	r.Handle("/{id:[0-9a-f]+}", handleGetRecording(rs)).Methods(http.MethodGet)
+	r.Handle("/{id:[0-9a-f]+}/cast", handleDownloadRecording(rs)).Methods(http.MethodGet)
+	r.Handle("/ui", http.RedirectHandler("ui/", http.StatusMovedPermanently))
+	r.Handle("/ui/{file:[a-z.]*}", handleRecordingsUI()).Methods(http.MethodGet)
+}
+
+func recordingError(err error) error {
+	if errors.Is(err, ssh.ErrRecordingNotFound) {
+		return &HTTPError{http.StatusNotFound, err}
+	}
+	return err
+}
+
+// parseRecordingFilter reads the filter from the query parameters.
+func parseRecordingFilter(q url.Values) (ssh.RecordingFilter, error) {
+	f := ssh.RecordingFilter{
+		SrcNode:      q.Get("srcNode"),
+		SrcNodeID:    q.Get("srcNodeID"),
+		SrcNodeUser:  q.Get("srcNodeUser"),
+		SSHUser:      q.Get("sshUser"),
+		LocalUser:    q.Get("localUser"),
+		ConnectionID: q.Get("connectionID"),
+		TargetNode:   q.Get("targetNode"),
+		TargetNodeID: q.Get("targetNodeID"),
+		Kind:         q.Get("kind"),
+		Cluster:      q.Get("cluster"),
+		Namespace:    q.Get("namespace"),
+		Pod:          q.Get("pod"),
+		Container:    q.Get("container"),
+		Command:      q.Get("command"),
+	}
+	for name, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		*t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, &HTTPError{http.StatusBadRequest, errors.Errorf("invalid %s: %w", name, err)}
+		}
+	}
+	return f, nil
+}
+
+func handleListRecordings(rs *ssh.RecordingService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		f, err := parseRecordingFilter(r.URL.Query())
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, rs.Index.List(f))
+	})
+}
+
+func handleGetRecording(rs *ssh.RecordingService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		rec, err := rs.Index.Get(mux.Vars(r)["id"])
+		if err != nil {
+			return recordingError(err)
+		}
+		return writeJSON(w, rec)
+	})
+}
+
+func handleRecordingsUI() http.Handler {
+	web := ssh.Web()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := mux.Vars(r)["file"]
+		if file == "" {
+			file = "index.html"
+		}
+		http.ServeFileFS(w, r, web, file)
+	})
+}
+
+func handleVerifyRecordings(rs *ssh.RecordingService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		if rs.Manifests == nil {
+			return &HTTPError{http.StatusNotFound, errors.New("signing of recordings is not configured")}
+		}
+		// all recordings are hashed, which takes longer than the write timeout of the server
+		err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		if err != nil {
+			return errors.Errorf("setting write deadline: %w", err)
+		}
+		report, err := rs.Verify()
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, report)
+	})
+}
+
+func handleDownloadRecording(rs *ssh.RecordingService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		f, rec, err := rs.Open(mux.Vars(r)["id"])
+		if err != nil {
+			return recordingError(err)
+		}
+		defer f.Close()
+		// long recordings and slow clients take longer than the write timeout of the server
+		err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		if err != nil {
+			return errors.Errorf("setting write deadline: %w", err)
+		}
+		if rec.Encrypted {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/x-asciicast")
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": rec.Filename()}))
+		_, err = io.Copy(w, f)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Sending recording %s", rec.ID)
+		}
+		return nil
+	})
+}
+
+// decodeBody returns a reader for the decompressed request body that enforces the size limits.
+func decodeBody(w http.ResponseWriter, r *http.Request, l types.LimitsConfig) (io.ReadCloser, error) {
+	var body io.Reader = r.Body
+	if l.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, l.MaxBodySize)
+	}
+	var decoded io.ReadCloser
+	var err error
+	encoding := r.Header.Get("Content-Encoding")
+	switch encoding {
+	case "", "identity":
+		decoded = io.NopCloser(body)
+	case "zstd":
+		decoded, err = util.NewZstdReader(body)
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(body)
+	case "deflate":
+		decoded, err = zlib.NewReader(body)
+	default:
+		return nil, &HTTPError{http.StatusUnsupportedMediaType, errors.Errorf("unsupported content encoding %s", encoding)}
+	}
+	if err != nil {
+		return nil, bodyError(err, l)
+	}
+	if l.MaxDecodedSize > 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{util.NewLimitReader(decoded, l.MaxDecodedSize), decoded}, nil
+	}
+	return decoded, nil
+}
+
+// bodyError converts an error that occurred while reading the request body into an HTTPError.
+func bodyError(err error, l types.LimitsConfig) error {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &HTTPError{http.StatusRequestEntityTooLarge, errors.Errorf("request body larger than %d bytes", l.MaxBodySize)}
+	case errors.Is(err, util.ErrTooLarge):
+		return &HTTPError{http.StatusRequestEntityTooLarge, errors.Errorf("decoded request body larger than %d bytes", l.MaxDecodedSize)}
+	default:
+		return &HTTPError{http.StatusBadRequest, errors.Errorf("reading request body: %w", err)}
+	}
+}
+
+// decodeEntries decodes the JSON array of log entries in r one entry at a time and calls fn for each of them.
+// It returns the number of decoded entries.
+func decodeEntries(r io.Reader, fn func(map[string]interface{})) (int, error) {
+	dec := json.NewDecoder(r)
+	t, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if t != json.Delim('[') {
+		return 0, errors.Errorf("expected array of log entries, got %v", t)
+	}
+	n := 0
+	for dec.More() {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			return n, err
+		}
+		fn(m)
+		n++
+	}
+	// the closing bracket
+	if _, err := dec.Token(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// resubmitHeader marks uploads of `loghead deadletter resubmit`, its value is the id of the dead letter.
+// Resubmitted batches that fail again are rejected instead of being stored as another dead letter.
+const resubmitHeader = "Loghead-Resubmit"
+
+// outputsHeader limits a resubmitted batch to the comma separated outputs that failed to process it before.
+const outputsHeader = "Loghead-Outputs"
+
+// resubmission returns the id of the dead letter that the request resubmits.
+// The resubmit headers are only honored for stored dead letters and peers that may use the dead letter store,
+// otherwise any uploader could skip the sequence check or outputs.
+func resubmission(r *http.Request, p pipeline, peer *types.PeerIdentity) string {
+	id := r.Header.Get(resubmitHeader)
+	if id == "" {
+		return ""
+	}
+	if p.DeadLetter == nil || p.Policy == nil || !p.Policy.Allowed(policy.DeadLetter, r.RemoteAddr, peer) {
+		log.Warn().Str("remote_addr", r.RemoteAddr).Msgf("Ignoring resubmit headers for dead letter %s, the dead letter store is not available to the client", id)
+		return ""
+	}
+	if _, err := p.DeadLetter.Get(id); err != nil {
+		log.Warn().Err(err).Str("remote_addr", r.RemoteAddr).Msgf("Ignoring resubmit headers for unknown dead letter %s", id)
+		return ""
+	}
+	return id
+}
+
+// pipeline holds the services that process client log uploads.
+// Services that are not configured are nil.
+type pipeline struct {
+	Limits     types.LimitsConfig
+	Forward    *logs.ForwardingService
+	FileLogger *logs.FileLoggerService
+	Hostinfo   *logs.HostInfoService
+	Metrics    *logs.MetricsService
+	Sequence   *logs.SequenceService
+	Filters    *logs.FilterService
+	Annotate   *logs.AnnotationService
+	Transform  *logs.TransformService
+	Script     *logs.ScriptService
+	External   *logs.ExternalProcessorService
+	DeadLetter *logs.DeadLetterService
+	// Redactor is applied to every entry when it is decoded
+	Redactor *logs.Redactor
+	// Policy decides whether a client may resubmit dead letters
+	Policy *policy.PolicyService
+}
+
+func handleTailnodeLogs(p pipeline) http.Handler {
 	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
 		vars := mux.Vars(r)
 		collection := vars["collection"]
 		private_id := vars["private_id"]
+		serverTime := time.Now()
+		source := r.RemoteAddr
+		peer := types.PeerIdentityFromContext(r.Context())
+		if peer != nil {
+			source = peer.NodeName
+		}
 
-		msg, err := io.ReadAll(r.Body)
-		if err != nil {
-			return errors.Errorf("reading request body: %w", err)
+		// keep the body as received in case the batch has to be dead lettered
+		var received bytes.Buffer
+		if p.DeadLetter != nil && p.Redactor == nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, &received), r.Body}
 		}
-		if r.Header.Get("Content-Encoding") == "zstd" {
-			msg = util.ZstdDecode(msg)
+		resubmitted := resubmission(r, p, peer)
+		// a partially processed batch is only passed to the outputs that failed
+		var only []string
+		if v := r.Header.Get(outputsHeader); resubmitted != "" && v != "" {
+			only = strings.Split(v, ",")
 		}
-
-		if fwd != nil {
-			err := fwd.Forward(msg)
+		enabled := func(output string) bool {
+			return only == nil || slices.Contains(only, output)
+		}
+		// with redaction only the redacted entries are kept for dead letters
+		redacted := []json.RawMessage{}
+		// deadLetter stores the batch if it was rejected because of its content.
+		// outputs are the outputs that failed, if the batch was processed.
+		// logtail retries failed uploads forever, so a stored batch is acknowledged to the client.
+		deadLetter := func(reason error, outputs ...string) error {
+			var httpErr *HTTPError
+			if p.DeadLetter == nil || resubmitted != "" || (errors.As(reason, &httpErr) && httpErr.Code == http.StatusRequestEntityTooLarge) {
+				return reason
+			}
+			encoding := r.Header.Get("Content-Encoding")
+			var stored []byte
+			if p.Redactor != nil {
+				// of a body that cannot be decoded, the entries before the error are stored
+				b, err := json.Marshal(redacted)
+				if err != nil {
+					return errors.Join(reason, errors.Errorf("marshaling dead letter: %w", err))
+				}
+				stored, encoding = b, ""
+			} else {
+				// read the rest of the body
+				var rest io.Reader = r.Body
+				if p.Limits.MaxBodySize > 0 {
+					rest = io.LimitReader(r.Body, p.Limits.MaxBodySize-int64(received.Len())+1)
+				}
+				_, _ = io.Copy(io.Discard, rest)
+				stored = received.Bytes()
+			}
+			d, err := p.DeadLetter.Store(logs.DeadLetter{
+				Collection: collection,
+				PrivateID:  private_id,
+				Source:     source,
+				Encoding:   encoding,
+				Error:      reason.Error(),
+				Time:       serverTime,
+				Outputs:    outputs,
+			}, stored)
 			if err != nil {
-				log.Error().Err(err).Msg("error forwarding")
+				return errors.Join(reason, errors.Errorf("storing dead letter: %w", err))
 			}
+			log.Warn().Err(reason).Str("source", source).Strs("outputs", outputs).Msgf("Stored rejected batch for %s/%s as dead letter %s", collection, private_id, d.ID)
+			w.WriteHeader(http.StatusOK)
+			return nil
 		}
 
-		var maps []map[string]interface{}
-		err = json.Unmarshal(msg, &maps)
+		body, err := decodeBody(w, r, p.Limits)
 		if err != nil {
-			return errors.Errorf("message unmarshal: %w", err)
+			return deadLetter(err)
 		}
-		log.Debug().Msgf("Received %d messages for %s/%s", len(maps)+1, collection, private_id)
+		defer body.Close()
 
-		for _, m := range maps {
+		// the other outputs processed a partially processed batch already
+		forward := p.Forward != nil && only == nil
+		// the forwarder needs the whole decoded body unless entries are redacted, filtered, transformed or scripted
+		reencode := forward && (p.Redactor != nil || p.Forward.Redactor != nil || p.Filters != nil || p.Transform != nil || p.Script != nil)
+		var raw bytes.Buffer
+		var entries io.Reader = body
+		if forward && !reencode {
+			entries = io.TeeReader(body, &raw)
+		}
+		var processorErr error
+		var failed []string
+		fail := func(output string, err error) {
+			processorErr = errors.Join(processorErr, errors.Errorf("%s: %w", output, err))
+			if !slices.Contains(failed, output) {
+				failed = append(failed, output)
+			}
+		}
+		// the side effects of the entries are staged while the body is decoded
+		// and only committed once the whole batch was decoded,
+		// so that a rejected batch leaves no partial writes behind that a retry would duplicate
+		var seq *logs.SequenceBatch
+		// resubmitted entries were seen before or are older than the entries received since
+		if p.Sequence != nil && resubmitted == "" {
+			seq = p.Sequence.Batch()
+		}
+		// entries are written to the files at once, so that uploads of the same node are not interleaved
+		var files *logs.FileBatch
+		// the records of the external processor are written instead
+		if p.FileLogger != nil && (p.External == nil || !p.External.Replace) && enabled(logs.OutputFileLogger) {
+			files = p.FileLogger.NewBatch()
+		}
+		// entries are passed to the external processor once per upload
+		var external *logs.ExternalBatch
+		if p.External != nil && enabled(logs.OutputExternal) {
+			external = p.External.NewBatch()
+		}
+		// entries that are forwarded re-encoded
+		var forwarded []json.RawMessage
+		var encodeErr error
+		// entries with client metrics
+		var metrics []logs.LogtailMsg
+		// output passes a processed entry to the forwarder, the external processor and the filelogger
+		output := func(msg logs.LogtailMsg) {
+			if reencode {
+				m := msg.Msg
+				if p.Forward.Redactor != nil {
+					m = p.Forward.Redactor.Redact(m)
+				}
+				b, err := json.Marshal(m)
+				if err != nil {
+					encodeErr = errors.Join(encodeErr, err)
+				}
+				forwarded = append(forwarded, b)
+			}
+			if external != nil {
+				external.Add(msg)
+			}
+			if files != nil {
+				files.Add(msg)
+			}
+		}
+		n, err := decodeEntries(entries, func(m map[string]interface{}) {
+			// no processor or output sees the entry before it is redacted
+			if p.Redactor != nil {
+				m = p.Redactor.Redact(m)
+				if p.DeadLetter != nil && resubmitted == "" {
+					if b, err := json.Marshal(m); err != nil {
+						log.Warn().Err(err).Str("private_id", private_id).Msg("Could not encode redacted entry for the dead letter store")
+					} else {
+						redacted = append(redacted, b)
+					}
+				}
+			}
 			msg := logs.LogtailMsg{
 				Msg:        m,
 				Collection: collection,
 				PrivateID:  private_id,
+				ServerTime: serverTime,
+				Source:     source,
+				Peer:       peer,
+			}
+			if seq != nil && !seq.Process(msg) {
+				return
+			}
+			if p.Filters != nil && !p.Filters.Process(msg) {
+				return
 			}
-			if fl != nil {
-				fl.Log(msg)
+			if p.Annotate != nil {
+				p.Annotate.Process(msg)
 			}
-			if hi != nil {
-				hi.Process(msg)
+			// hostinfo and metrics read fields that the transform and the script may rename or remove
+			if p.Hostinfo != nil && only == nil {
+				p.Hostinfo.Process(msg)
 			}
-			if ms != nil {
-				ms.Process(msg)
+			if v, ok := m["metrics"]; ok && p.Metrics != nil && only == nil {
+				metrics = append(metrics, logs.LogtailMsg{Msg: map[string]interface{}{"metrics": v}, PrivateID: private_id})
 			}
+			if p.Transform != nil {
+				p.Transform.Process(msg)
+			}
+			if p.Script != nil {
+				keep, derived := p.Script.Process(msg)
+				if keep {
+					output(msg)
+				}
+				for _, d := range derived {
+					output(d)
+				}
+				return
+			}
+			output(msg)
+		})
+		if err != nil {
+			return deadLetter(bodyError(err, p.Limits))
+		}
+		log.Debug().Str("source", source).Msgf("Received %d messages for %s/%s", n, collection, private_id)
+
+		// commit applies the staged state once the batch is acknowledged, the client does not upload it again.
+		// A batch that is not acknowledged is retried and must not be seen as duplicates then.
+		commit := func() {
+			if seq != nil {
+				seq.Commit()
+			}
+			for _, m := range metrics {
+				p.Metrics.Process(m)
+			}
+		}
+		if files != nil {
+			if err := files.Write(); err != nil {
+				fail(logs.OutputFileLogger, err)
+			}
+		}
+
+		if forward {
+			b := raw.Bytes()
+			if reencode {
+				if encodeErr != nil {
+					return errors.Errorf("marshaling forwarded entries: %w", encodeErr)
+				}
+				b, err = json.Marshal(forwarded)
+				if err != nil {
+					return errors.Errorf("marshaling forwarded entries: %w", err)
+				}
+			}
+			err := p.Forward.Forward(b)
+			if err != nil {
+				log.Error().Err(err).Msg("error forwarding")
+			}
+		}
+
+		if processorErr != nil {
+			// the external processor only receives accepted batches
+			if external != nil {
+				failed = append(failed, logs.OutputExternal)
+			}
+			if err := deadLetter(errors.Errorf("processing batch: %w", processorErr), failed...); err != nil {
+				return err
+			}
+			commit()
+			return nil
+		}
+		commit()
+		if external != nil {
+			p.External.EnqueueBatch(external)
 		}
 
 		w.WriteHeader(http.StatusOK)
@@ -128,8 +783,81 @@ func handleTailnodeLogs(
 	})
 }
 
-func handleMetrics(ms *logs.MetricsService) http.Handler {
-	return ms.PromHandler()
+func addDeadLetterRoutes(
+	r *mux.Router,
+	dl *logs.DeadLetterService) {
+	r.Handle("", handleListDeadLetters(dl)).Methods(http.MethodGet)
+	r.Handle("/{id}", handleGetDeadLetter(dl)).Methods(http.MethodGet)
+	r.Handle("/{id}/body", handleGetDeadLetterBody(dl)).Methods(http.MethodGet)
+	r.Handle("/{id}", handleDeleteDeadLetter(dl)).Methods(http.MethodDelete)
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func deadLetterError(err error) error {
+	if errors.Is(err, logs.ErrDeadLetterNotFound) {
+		return &HTTPError{http.StatusNotFound, err}
+	}
+	return err
+}
+
+func handleListDeadLetters(dl *logs.DeadLetterService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		ds, err := dl.List()
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, ds)
+	})
+}
+
+func handleGetDeadLetter(dl *logs.DeadLetterService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		d, err := dl.Get(mux.Vars(r)["id"])
+		if err != nil {
+			return deadLetterError(err)
+		}
+		return writeJSON(w, d)
+	})
+}
+
+func handleGetDeadLetterBody(dl *logs.DeadLetterService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		id := mux.Vars(r)["id"]
+		d, err := dl.Get(id)
+		if err != nil {
+			return deadLetterError(err)
+		}
+		b, err := dl.Body(id)
+		if err != nil {
+			return deadLetterError(err)
+		}
+		// the body is returned as received
+		if d.Encoding != "" {
+			w.Header().Set("Content-Encoding", d.Encoding)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		return err
+	})
+}
+
+func handleDeleteDeadLetter(dl *logs.DeadLetterService) http.Handler {
+	return FailableHandler(func(w http.ResponseWriter, r *http.Request) error {
+		err := dl.Delete(mux.Vars(r)["id"])
+		if err != nil {
+			return deadLetterError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+func handleMetrics(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
 }
 
 func handleNodeMetrics(nm *node_metrics.NodeMetricsService) http.Handler {
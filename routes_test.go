@@ -0,0 +1,942 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/qup42/loghead/limits"
+	"github.com/qup42/loghead/logs"
+	"github.com/qup42/loghead/policy"
+	"github.com/qup42/loghead/ssh"
+	"github.com/qup42/loghead/types"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tailcfg"
+	"testing"
+	"time"
+)
+
+const testEntries = `[{"text": "a"}, {"text": "b"}, {"text": "c"}]`
+
+func encode(t *testing.T, encoding string, in []byte) []byte {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "":
+		return in
+	case "zstd":
+		w, err = zstd.NewWriter(&b)
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "deflate":
+		w = zlib.NewWriter(&b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// stubWhoIs knows the peers by their remote address.
+type stubWhoIs map[string]*apitype.WhoIsResponse
+
+func (s stubWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if w, ok := s[remoteAddr]; ok {
+		return w, nil
+	}
+	return nil, errors.New("no match for IP:port")
+}
+
+func TestIdentifyPeer(t *testing.T) {
+	tsnet := &types.Listener{LocalClient: stubWhoIs{
+		"100.64.0.1:1234": {
+			Node:        &tailcfg.Node{Name: "laptop.tail1234.ts.net.", StableID: "n1", Tags: []string{"tag:ci"}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		},
+	}}
+	laptop := &types.PeerIdentity{NodeName: "laptop.tail1234.ts.net", NodeID: "n1", Tags: []string{"tag:ci"}, User: "alice@example.com"}
+	tests := []struct {
+		name         string
+		ln           *types.Listener
+		requireKnown bool
+		remoteAddr   string
+		code         int
+		peer         *types.PeerIdentity
+	}{
+		{name: "known", ln: tsnet, remoteAddr: "100.64.0.1:1234", code: http.StatusOK, peer: laptop},
+		{name: "known required", ln: tsnet, requireKnown: true, remoteAddr: "100.64.0.1:1234", code: http.StatusOK, peer: laptop},
+		{name: "unknown", ln: tsnet, remoteAddr: "100.64.0.2:1234", code: http.StatusOK},
+		{name: "unknown required", ln: tsnet, requireKnown: true, remoteAddr: "100.64.0.2:1234", code: http.StatusForbidden},
+		// plain listeners cannot identify peers
+		{name: "plain", ln: &types.Listener{}, requireKnown: true, remoteAddr: "192.0.2.1:1234", code: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var peer *types.PeerIdentity
+			h := identifyPeer(tc.ln, tc.requireKnown)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				peer = types.PeerIdentityFromContext(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.code || !reflect.DeepEqual(peer, tc.peer) {
+				t.Fatalf(`identifyPeer() = %d, %+v, want %d, %+v`, rec.Code, peer, tc.code, tc.peer)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		limits   types.LimitsConfig
+		n        int
+		code     int
+	}{
+		{name: "plain", encoding: "", body: []byte(testEntries), n: 3},
+		{name: "zstd", encoding: "zstd", body: []byte(testEntries), n: 3},
+		{name: "gzip", encoding: "gzip", body: []byte(testEntries), n: 3},
+		{name: "deflate", encoding: "deflate", body: []byte(testEntries), n: 3},
+		{name: "empty", encoding: "", body: []byte(""), code: http.StatusBadRequest},
+		{name: "empty array", encoding: "", body: []byte("[]"), n: 0},
+		{name: "not an array", encoding: "", body: []byte(`{"text": "a"}`), code: http.StatusBadRequest},
+		{name: "truncated", encoding: "", body: []byte(testEntries[:20]), code: http.StatusBadRequest},
+		{name: "body too large", encoding: "gzip", body: []byte(testEntries), limits: types.LimitsConfig{MaxBodySize: 10}, code: http.StatusRequestEntityTooLarge},
+		{name: "decoded too large", encoding: "zstd", body: []byte(testEntries), limits: types.LimitsConfig{MaxDecodedSize: 10}, code: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encode(t, tc.encoding, tc.body)))
+			r.Header.Set("Content-Encoding", tc.encoding)
+			body, err := decodeBody(httptest.NewRecorder(), r, tc.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			n, err := decodeEntries(body, func(map[string]interface{}) {})
+			code := 0
+			if err != nil {
+				var httpErr *HTTPError
+				if !errors.As(bodyError(err, tc.limits), &httpErr) {
+					t.Fatalf("bodyError(%s) is not an HTTPError", err)
+				}
+				code = httpErr.Code
+			}
+			if code != tc.code || (code == 0 && n != tc.n) {
+				t.Fatalf(`decoding "%s" = %d entries, status %d, want %d entries, status %d`, tc.body, n, code, tc.n, tc.code)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyInvalid(t *testing.T) {
+	for _, encoding := range []string{"zstd", "gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(testEntries)))
+			r.Header.Set("Content-Encoding", encoding)
+			body, err := decodeBody(httptest.NewRecorder(), r, types.LimitsConfig{})
+			if err == nil {
+				_, err = decodeEntries(body, func(map[string]interface{}) {})
+				body.Close()
+				err = bodyError(err, types.LimitsConfig{})
+			}
+			var httpErr *HTTPError
+			if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest {
+				t.Fatalf(`decoding uncompressed body as %s = %v, want status %d`, encoding, err, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// newClientLogsServer serves the upload handler of client logs.
+func newClientLogsServer(t *testing.T, h http.Handler) *httptest.Server {
+	r := mux.NewRouter()
+	r.Handle("/c/{collection}/{private_id}", h)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// postBatch uploads a batch of client logs and returns the status code.
+func postBatch(t *testing.T, srv *httptest.Server, body string, header http.Header) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/c/"+logs.TailnodeCollection+"/0123abcd", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// newRecorderServer serves the SSH recording routes like the SSH recorder listener and records the requests.
+func newRecorderServer(t *testing.T) (*ssh.RecordingService, *httptest.Server, func() []string) {
+	rs, err := ssh.NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	addSSHRecordingRoutes(r, rs)
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, fmt.Sprintf("%s %s %s", req.Proto, req.Method, req.URL.Path))
+		mu.Unlock()
+		r.ServeHTTP(w, req)
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return rs, srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(requests)
+	}
+}
+
+func readRecording(t *testing.T, rs *ssh.RecordingService) []byte {
+	t.Helper()
+	recs := rs.Index.List(ssh.RecordingFilter{})
+	if len(recs) != 1 {
+		t.Fatalf(`List() = %+v, want 1 recording`, recs)
+	}
+	f, _, err := rs.Open(recs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestSSHRecordingV2Client uploads a recorded session with the session recording client of tailscale.
+func TestSSHRecordingV2Client(t *testing.T) {
+	session, err := os.ReadFile("testdata/ssh_session.cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, srv, requests := newRecorderServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var d net.Dialer
+	w, _, errc, err := sessionrecording.ConnectToRecorder(ctx, []netip.AddrPort{netip.MustParseAddrPort(srv.Listener.Addr().String())}, d.DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range bytes.SplitAfter(session, []byte("\n")) {
+		if _, err := w.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"HTTP/2.0 HEAD /v2/record", "HTTP/2.0 POST /v2/record"}
+	if got := requests(); !reflect.DeepEqual(got, want) {
+		t.Fatalf(`requests = %v, want %v`, got, want)
+	}
+	if got := readRecording(t, rs); !bytes.Equal(got, session) {
+		t.Fatalf(`recording = %q, want %q`, got, session)
+	}
+}
+
+// startV2Upload starts an upload to /v2/record and returns the writer for the recording and a decoder for the frames.
+func startV2Upload(t *testing.T, srv *httptest.Server) (*io.PipeWriter, *json.Decoder) {
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(tr.CloseIdleConnections)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v2/record", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf(`response = %s %s, want HTTP/2 200`, resp.Proto, resp.Status)
+	}
+	return pw, json.NewDecoder(resp.Body)
+}
+
+func TestSSHRecordingV2Acks(t *testing.T) {
+	session, err := os.ReadFile("testdata/ssh_session.cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, srv, _ := newRecorderServer(t)
+	pw, dec := startV2Upload(t, srv)
+
+	// acks follow the durably written bytes
+	half := bytes.Index(session, []byte("\n[2.652107"))
+	if _, err := pw.Write(session[:half]); err != nil {
+		t.Fatal(err)
+	}
+	var ack int64
+	for ack < int64(half) {
+		var f recordingFrame
+		if err := dec.Decode(&f); err != nil || f.Error != "" || f.Ack < ack || f.Ack > int64(half) {
+			t.Fatalf(`frame = %+v, %s, want ack up to %d`, f, err, half)
+		}
+		ack = f.Ack
+	}
+
+	// the last ack covers the whole recording
+	if _, err := pw.Write(session[half:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	for {
+		var f recordingFrame
+		err := dec.Decode(&f)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil || f.Error != "" {
+			t.Fatalf(`frame = %+v, %s`, f, err)
+		}
+		ack = f.Ack
+	}
+	if ack != int64(len(session)) {
+		t.Fatalf(`last ack = %d, want %d`, ack, len(session))
+	}
+	if got := readRecording(t, rs); !bytes.Equal(got, session) {
+		t.Fatalf(`recording = %q, want %q`, got, session)
+	}
+}
+
+func TestSSHRecordingV2Error(t *testing.T) {
+	_, srv, _ := newRecorderServer(t)
+	pw, dec := startV2Upload(t, srv)
+	if _, err := pw.Write([]byte("not a recording\n")); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	var f recordingFrame
+	if err := dec.Decode(&f); err != nil || f.Error == "" {
+		t.Fatalf(`frame = %+v, %s, want an error`, f, err)
+	}
+}
+
+func TestSSHRecordingTargetNode(t *testing.T) {
+	rs, err := ssh.NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir(), Naming: "{{.TargetNodeID}}/{{.Timestamp}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	// as identified by identifyPeer on a tsnet listener
+	target := &types.PeerIdentity{NodeName: "server.tail1234.ts.net", NodeID: "n9", Tags: []string{"tag:server"}}
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(types.WithPeerIdentity(req.Context(), target)))
+		})
+	})
+	addSSHRecordingRoutes(r, rs)
+	body := `{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","sshUser":"root","localUser":"root","connectionID":"c1"}` + "\n" + `[1,"o","hello"]` + "\n"
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	res, err := http.Post(srv.URL+"/record", "application/octet-stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf(`POST /record = %d`, res.StatusCode)
+	}
+
+	recs := rs.Index.List(ssh.RecordingFilter{TargetNodeID: "n9"})
+	if len(recs) != 1 {
+		t.Fatalf(`List() = %+v, want 1 recording`, recs)
+	}
+	rec := recs[0]
+	if rec.TargetNode != target.NodeName || !reflect.DeepEqual(rec.TargetNodeTags, target.Tags) || rec.Path != "n9/"+time.Unix(1735689600, 0).Format(time.RFC3339)+".cast" {
+		t.Fatalf(`recording = %+v`, rec)
+	}
+	// indexed from the sidecar
+	idx := ssh.NewIndex()
+	if err := idx.Rebuild(rs.Dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := idx.Get(rec.ID); err != nil || got.TargetNodeID != "n9" || got.TargetNode != target.NodeName {
+		t.Fatalf(`Get(%s) = %+v, %s`, rec.ID, got, err)
+	}
+}
+
+// newRecordingsServer serves the recordings API like the SSH recorder listener, with the write timeout of the server.
+func newRecordingsServer(t *testing.T, rs *ssh.RecordingService, writeTimeout time.Duration) *httptest.Server {
+	r := mux.NewRouter()
+	addRecordingsRoutes(r.PathPrefix("/recordings").Subrouter(), rs)
+	srv := httptest.NewUnstartedServer(r)
+	srv.Config.WriteTimeout = writeTimeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getRecordings(t *testing.T, srv *httptest.Server, path string, v any) int {
+	t.Helper()
+	res, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestListRecordings(t *testing.T) {
+	rs, err := ssh.NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","sshUser":"root","localUser":"root","connectionID":"c1"}` + "\n" + `[12.25,"o","bye"]` + "\n",
+		`{"version":2,"timestamp":1735693200,"command":"uptime","srcNode":"desktop","srcNodeID":"n2","sshUser":"alice","localUser":"alice","connectionID":"c2"}` + "\n" + `[1,"o","up"]` + "\n",
+	} {
+		if err := rs.Record(io.NopCloser(strings.NewReader(body)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := newRecordingsServer(t, rs, 0)
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		want  []string
+	}{
+		{name: "all", query: "", code: http.StatusOK, want: []string{"c2", "c1"}},
+		{name: "field", query: "?srcNode=laptop", code: http.StatusOK, want: []string{"c1"}},
+		{name: "command", query: "?command=up", code: http.StatusOK, want: []string{"c2"}},
+		// c1 ended at 00:00:12
+		{name: "from", query: "?from=2025-01-01T00:30:00Z", code: http.StatusOK, want: []string{"c2"}},
+		{name: "to", query: "?to=2025-01-01T00:30:00Z", code: http.StatusOK, want: []string{"c1"}},
+		{name: "range", query: "?from=2025-01-01T00:00:10Z&to=2025-01-01T00:30:00%2B00:00", code: http.StatusOK, want: []string{"c1"}},
+		{name: "no match", query: "?from=2025-01-02T00:00:00Z", code: http.StatusOK, want: nil},
+		{name: "invalid from", query: "?from=yesterday", code: http.StatusBadRequest},
+		{name: "invalid to", query: "?to=1735693200", code: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var recs []ssh.Recording
+			code := getRecordings(t, srv, "/recordings"+tc.query, &recs)
+			var got []string
+			for _, r := range recs {
+				got = append(got, r.ConnectionID)
+			}
+			if code != tc.code || !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf(`GET /recordings%s = %d, %v, want %d, %v`, tc.query, code, got, tc.code, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetRecording(t *testing.T) {
+	rs, err := ssh.NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","sshUser":"root","localUser":"root","connectionID":"c1"}` + "\n" + `[12.25,"o","bye"]` + "\n"
+	if err := rs.Record(io.NopCloser(strings.NewReader(body)), nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := newRecordingsServer(t, rs, 0)
+	id := rs.Index.List(ssh.RecordingFilter{})[0].ID
+
+	var rec ssh.Recording
+	if code := getRecordings(t, srv, "/recordings/"+id, &rec); code != http.StatusOK || rec.ID != id || rec.SrcNode != "laptop" ||
+		!rec.End.Equal(time.Unix(1735689600, 0).Add(12250*time.Millisecond)) {
+		t.Fatalf(`GET /recordings/%s = %d, %+v`, id, code, rec)
+	}
+	for _, path := range []string{"/recordings/0123456789abcdef", "/recordings/0123456789abcdef/cast"} {
+		if code := getRecordings(t, srv, path, nil); code != http.StatusNotFound {
+			t.Fatalf(`GET %s = %d, want %d`, path, code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestDownloadRecording(t *testing.T) {
+	rs, err := ssh.NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","sshUser":"root","localUser":"root","connectionID":"c1"}`
+	body := meta + "\n" + strings.Repeat(`[1,"o","`+strings.Repeat("x", 1000)+`"]`+"\n", 4<<10)
+	if err := rs.Record(io.NopCloser(strings.NewReader(body)), nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := newRecordingsServer(t, rs, 100*time.Millisecond)
+
+	var recs []ssh.Recording
+	if code := getRecordings(t, srv, "/recordings", &recs); code != http.StatusOK || len(recs) != 1 || recs[0].ConnectionID != "c1" {
+		t.Fatalf(`GET /recordings = %d, %+v`, code, recs)
+	}
+	res, err := http.Get(srv.URL + "/recordings/" + recs[0].ID + "/cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "application/x-asciicast" ||
+		res.Header.Get("Content-Disposition") != `attachment; filename="`+time.Unix(1735689600, 0).Format(time.RFC3339)+`.cast"` {
+		t.Fatalf(`headers = %v`, res.Header)
+	}
+	// a slow client reads the recording after the write timeout
+	time.Sleep(300 * time.Millisecond)
+	b, err := io.ReadAll(res.Body)
+	if err != nil || string(b) != body {
+		t.Fatalf(`downloaded %d bytes, %v, want %d bytes`, len(b), err, len(body))
+	}
+}
+
+func TestUploadRejectedBatch(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := logs.NewFileLoggerService(types.FileLoggerConfig{Dir: dir, Format: logs.FormatJSON, Fsync: logs.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := logs.NewSequenceService(prometheus.NewRegistry())
+	l := types.LimitsConfig{MaxDecodedSize: 256}
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{Limits: l, FileLogger: fl, Sequence: ss}))
+
+	a := `{"logtail": {"proc_id": 1, "proc_seq": 1}, "text": "a"}`
+	b := `{"logtail": {"proc_id": 1, "proc_seq": 2}, "text": "b"}`
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "truncated", body: `[` + a + `, {"text": "b"`, code: http.StatusBadRequest},
+		{name: "malformed", body: `[` + a + `, "b"]`, code: http.StatusBadRequest},
+		{name: "too large", body: `[` + a + `, {"text": "` + strings.Repeat("b", 256) + `"}]`, code: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		if code := postBatch(t, srv, tc.body, nil); code != tc.code {
+			t.Fatalf(`%s upload = %d, want %d`, tc.name, code, tc.code)
+		}
+	}
+	// nothing of the rejected batches was written
+	if _, err := os.Stat(filepath.Join(dir, logs.TailnodeCollection)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf(`collection directory exists after rejected uploads: %v`, err)
+	}
+	// the retry of the client
+	if code := postBatch(t, srv, `[`+a+`, `+b+`]`, nil); code != http.StatusOK {
+		t.Fatalf(`valid upload = %d, want %d`, code, http.StatusOK)
+	}
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, logs.TailnodeCollection, "0123abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"a", "b"} {
+		if n := bytes.Count(out, []byte(`"text":"`+text+`"`)); n != 1 {
+			t.Fatalf(`log file contains entry %s %d times, want once: %s`, text, n, out)
+		}
+	}
+	if dups := testutil.ToFloat64(ss.Duplicates.WithLabelValues("0123abcd")); dups != 0 {
+		t.Fatalf(`%f duplicates, want 0`, dups)
+	}
+}
+
+func TestUploadTransformedMetrics(t *testing.T) {
+	ms := logs.NewMetricsService(prometheus.NewRegistry())
+	ts := logs.NewTransformService(types.TransformConfig{Remove: []string{"metrics"}})
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{Metrics: ms, Transform: ts}))
+	if code := postBatch(t, srv, `[{"metrics": "N2anetmon_link_change_eqS0202"}]`, nil); code != http.StatusOK {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+	}
+	// the metrics are read before the transform removes them
+	if m, ok := ms.Metrics["0123abcd"][1]; !ok || m.Name != "netmon_link_change_eq" {
+		t.Fatalf(`Metrics = %+v, want netmon_link_change_eq`, ms.Metrics)
+	}
+}
+
+func TestUploadsNotInterleaved(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := logs.NewFileLoggerService(types.FileLoggerConfig{Dir: dir, Format: logs.FormatJSON, Fsync: logs.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{FileLogger: fl}))
+
+	var wg sync.WaitGroup
+	for _, upload := range []string{"a", "b"} {
+		entries := make([]map[string]interface{}, 2000)
+		for i := range entries {
+			entries[i] = map[string]interface{}{"text": upload}
+		}
+		body, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// postBatch cannot fail the test from another goroutine
+			res, err := http.Post(srv.URL+"/c/"+logs.TailnodeCollection+"/0123abcd", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf(`upload %s = %d, want %d`, upload, res.StatusCode, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, logs.TailnodeCollection, "0123abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	changes := 0
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != lines[i-1] {
+			changes++
+		}
+	}
+	if len(lines) != 4000 || changes != 1 {
+		t.Fatalf(`%d lines with %d changes between uploads, want 4000 lines and 1 change`, len(lines), changes)
+	}
+}
+
+func TestUploadFailedBatchSequence(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := logs.NewFileLoggerService(types.FileLoggerConfig{Dir: dir, Format: logs.FormatJSON, Fsync: logs.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	hs := logs.NewHostInfoService(prometheus.NewRegistry())
+	ss := logs.NewSequenceService(prometheus.NewRegistry())
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{FileLogger: fl, Hostinfo: hs, Sequence: ss}))
+
+	// the log file cannot be opened
+	p := filepath.Join(dir, logs.TailnodeCollection, "0123abcd")
+	if err := os.MkdirAll(p, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"logtail": {"proc_id": 1, "proc_seq": 1}, "Hostinfo": "invalid", "text": "a"}]`
+	if code := postBatch(t, srv, body, nil); code != http.StatusInternalServerError {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusInternalServerError)
+	}
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	// the retry is not a duplicate, an invalid Hostinfo does not reject the batch
+	if code := postBatch(t, srv, body, nil); code != http.StatusOK {
+		t.Fatalf(`retried upload = %d, want %d`, code, http.StatusOK)
+	}
+	if dups := testutil.ToFloat64(ss.Duplicates.WithLabelValues("0123abcd")); dups != 0 {
+		t.Fatalf(`%f duplicates, want 0`, dups)
+	}
+	if invalid := testutil.ToFloat64(hs.Invalid); invalid != 2 {
+		t.Fatalf(`%f invalid Hostinfo, want 2`, invalid)
+	}
+	out, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(out, []byte("\n")); lines != 1 {
+		t.Fatalf(`%d lines written, want 1`, lines)
+	}
+}
+
+func TestUploadRedacted(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := logs.NewFileLoggerService(types.FileLoggerConfig{Dir: dir, Format: logs.FormatJSON, Fsync: logs.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	rd, err := logs.NewRedactor("test", types.RedactionProfileConfig{Detectors: []string{"ipv4"}, Action: logs.RedactMask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := &logs.DeadLetterService{Dir: t.TempDir()}
+	srv := newClientLogsServer(t, handleTailnodeLogs(pipeline{FileLogger: fl, DeadLetter: dl, Redactor: rd}))
+
+	if code := postBatch(t, srv, `[{"text": "a from 192.0.2.1"}]`, nil); code != http.StatusOK {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, logs.TailnodeCollection, "0123abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"text":"a from [REDACTED]"}` + "\n"; string(out) != want {
+		t.Fatalf(`log file = %q, want %q`, out, want)
+	}
+
+	// the dead letter holds the redacted entries before the error
+	body := encode(t, "gzip", []byte(`[{"text": "b from 192.0.2.1"}, {"text": "c from 192.0.2.1"`))
+	if code := postBatch(t, srv, string(body), http.Header{"Content-Encoding": {"gzip"}}); code != http.StatusOK {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+	}
+	ds, err := dl.List()
+	if err != nil || len(ds) != 1 {
+		t.Fatalf(`List() = %+v, %s, want 1 dead letter`, ds, err)
+	}
+	if ds[0].Encoding != "" {
+		t.Fatalf(`dead letter encoding = %q, want none`, ds[0].Encoding)
+	}
+	b, err := dl.Body(ds[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"text":"b from [REDACTED]"}]`; string(b) != want {
+		t.Fatalf(`dead letter body = %s, want %s`, b, want)
+	}
+}
+
+func TestSSHRecorderRouterPolicy(t *testing.T) {
+	local := []string{"127.0.0.0/8"}
+	other := []string{"10.0.0.0/8"}
+	tests := []struct {
+		name       string
+		policy     types.PolicyConfig
+		recordings int
+		record     int
+	}{
+		{
+			name:       "recordings only",
+			policy:     types.PolicyConfig{SSHRecordings: types.PolicyRuleConfig{Enabled: true, CIDRs: other}, Recordings: types.PolicyRuleConfig{Enabled: true, CIDRs: local}},
+			recordings: http.StatusOK,
+			record:     http.StatusForbidden,
+		},
+		{
+			name:       "recorder only",
+			policy:     types.PolicyConfig{SSHRecordings: types.PolicyRuleConfig{Enabled: true, CIDRs: local}, Recordings: types.PolicyRuleConfig{Enabled: true, CIDRs: other}},
+			recordings: http.StatusForbidden,
+			record:     http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rs, err := ssh.NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps, err := policy.NewPolicyService(tc.policy, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &types.Config{SSHRecorder: types.SSHRecorderConfig{API: true}}
+			srv := httptest.NewServer(newSSHRecorderRouter(&types.Listener{}, c, ps, rs))
+			t.Cleanup(srv.Close)
+
+			if code := getRecordings(t, srv, "/recordings", nil); code != tc.recordings {
+				t.Fatalf(`GET /recordings = %d, want %d`, code, tc.recordings)
+			}
+			res, err := http.Head(srv.URL + "/v2/record")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.record {
+				t.Fatalf(`HEAD /v2/record = %d, want %d`, res.StatusCode, tc.record)
+			}
+		})
+	}
+}
+
+func TestClientLogsRouterPolicy(t *testing.T) {
+	local := []string{"127.0.0.0/8"}
+	other := []string{"10.0.0.0/8"}
+	tests := []struct {
+		name       string
+		policy     types.PolicyConfig
+		deadLetter int
+		upload     int
+	}{
+		{
+			name:       "dead letters only",
+			policy:     types.PolicyConfig{ClientLogs: types.PolicyRuleConfig{Enabled: true, CIDRs: other}, DeadLetter: types.PolicyRuleConfig{Enabled: true, CIDRs: local}},
+			deadLetter: http.StatusOK,
+			upload:     http.StatusForbidden,
+		},
+		{
+			name:       "uploads only",
+			policy:     types.PolicyConfig{ClientLogs: types.PolicyRuleConfig{Enabled: true, CIDRs: local}, DeadLetter: types.PolicyRuleConfig{Enabled: true, CIDRs: other}},
+			deadLetter: http.StatusForbidden,
+			upload:     http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ps, err := policy.NewPolicyService(tc.policy, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &types.Config{Loghead: types.LogheadConfig{
+				Collections: []string{logs.TailnodeCollection},
+				DeadLetter:  types.DeadLetterConfig{API: true},
+			}}
+			p := pipeline{DeadLetter: &logs.DeadLetterService{Dir: t.TempDir()}, Policy: ps}
+			rl := limits.NewRateLimitService(c.Loghead.Limits, prometheus.NewRegistry())
+			srv := httptest.NewServer(newClientLogsRouter(&types.Listener{}, c, p, rl, prometheus.NewRegistry()))
+			t.Cleanup(srv.Close)
+
+			res, err := http.Get(srv.URL + "/deadletter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.deadLetter {
+				t.Fatalf(`GET /deadletter = %d, want %d`, res.StatusCode, tc.deadLetter)
+			}
+			if code := postBatch(t, srv, testEntries, nil); code != tc.upload {
+				t.Fatalf(`upload = %d, want %d`, code, tc.upload)
+			}
+		})
+	}
+}
+
+func TestClientLogsRouterMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ss := logs.NewSequenceService(reg)
+	ps, err := policy.NewPolicyService(types.PolicyConfig{}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the metrics processor is disabled
+	c := &types.Config{Loghead: types.LogheadConfig{Collections: []string{logs.TailnodeCollection}}}
+	rl := limits.NewRateLimitService(c.Loghead.Limits, reg)
+	srv := httptest.NewServer(newClientLogsRouter(&types.Listener{}, c, pipeline{Sequence: ss, Policy: ps}, rl, reg))
+	t.Cleanup(srv.Close)
+
+	body := `[{"logtail": {"proc_id": 1, "proc_seq": 1}}, {"logtail": {"proc_id": 1, "proc_seq": 3}}]`
+	if code := postBatch(t, srv, body, nil); code != http.StatusOK {
+		t.Fatalf(`upload = %d, want %d`, code, http.StatusOK)
+	}
+	res, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || !bytes.Contains(b, []byte(`loghead_logtail_gap_entries_total{private_id="0123abcd"} 1`)) {
+		t.Fatalf(`GET /metrics = %d, want the gap counter: %s`, res.StatusCode, b)
+	}
+}
+
+func TestClientLogsCollections(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := logs.NewFileLoggerService(types.FileLoggerConfig{Dir: dir, Format: logs.FormatJSON, Fsync: logs.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	reg := prometheus.NewRegistry()
+	ps, err := policy.NewPolicyService(types.PolicyConfig{}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &types.Config{Loghead: types.LogheadConfig{Collections: []string{logs.TailnodeCollection, logs.TailtrafficCollection}}}
+	rl := limits.NewRateLimitService(c.Loghead.Limits, reg)
+	srv := httptest.NewServer(newClientLogsRouter(&types.Listener{}, c, pipeline{FileLogger: fl, Policy: ps}, rl, reg))
+	t.Cleanup(srv.Close)
+
+	upload := func(collection string, body string) int {
+		t.Helper()
+		res, err := http.Post(srv.URL+"/c/"+collection+"/0123abcd", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	exists := func(collection string) bool {
+		t.Helper()
+		_, err := os.Stat(filepath.Join(dir, collection))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	tests := []struct {
+		name       string
+		collection string
+		body       string
+		code       int
+		exists     bool
+	}{
+		{name: "unconfigured", collection: "other.log.tailscale.io", body: testEntries, code: http.StatusNotFound},
+		{name: "rejected", collection: logs.TailtrafficCollection, body: `[{"text"`, code: http.StatusBadRequest},
+		{name: "accepted", collection: logs.TailtrafficCollection, body: testEntries, code: http.StatusOK, exists: true},
+	}
+	for _, tc := range tests {
+		if code := upload(tc.collection, tc.body); code != tc.code {
+			t.Fatalf(`%s upload = %d, want %d`, tc.name, code, tc.code)
+		}
+		if e := exists(tc.collection); e != tc.exists {
+			t.Fatalf(`after %s upload the directory of %s exists = %t, want %t`, tc.name, tc.collection, e, tc.exists)
+		}
+	}
+	// directories of configured collections are only created on their first upload
+	if exists(logs.TailnodeCollection) {
+		t.Fatalf(`directory of %s exists without an upload`, logs.TailnodeCollection)
+	}
+}
@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"filippo.io/age"
+	"github.com/cockroachdb/errors"
+	"github.com/qup42/loghead/util"
+	"io"
+	"os"
+	"strings"
+)
+
+// extension of encrypted recordings, after .cast or .cast.zst
+const ageExt = ".age"
+
+// ParseRecipients parses age X25519 recipients, e.g. age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p.
+func ParseRecipients(rs []string) ([]age.Recipient, error) {
+	recipients := make([]age.Recipient, 0, len(rs))
+	for _, s := range rs {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, errors.Errorf("parsing recipient %q: %w", s, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// ReadIdentities reads age identities from a file as created by `age-keygen`.
+func ReadIdentities(p string) ([]age.Identity, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Errorf("reading identities: %w", err)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, errors.Errorf("parsing identities: %w", err)
+	}
+	return ids, nil
+}
+
+// DecryptRecording writes the decrypted and decompressed recording to w.
+// name is the file name of the recording, it tells whether the recording is compressed.
+func DecryptRecording(w io.Writer, r io.Reader, name string, ids ...age.Identity) error {
+	if !strings.HasSuffix(name, ageExt) {
+		return errors.Errorf("%s is not an encrypted recording", name)
+	}
+	dr, err := age.Decrypt(r, ids...)
+	if err != nil {
+		return errors.Errorf("decrypting recording: %w", err)
+	}
+	if strings.HasSuffix(strings.TrimSuffix(name, ageExt), zstdExt) {
+		zr, err := util.NewZstdReader(dr)
+		if err != nil {
+			return errors.Errorf("decompressing recording: %w", err)
+		}
+		defer zr.Close()
+		dr = zr
+	}
+	if _, err := io.Copy(w, dr); err != nil {
+		return errors.Errorf("decrypting recording: %w", err)
+	}
+	return nil
+}
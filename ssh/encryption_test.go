@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"bytes"
+	"filippo.io/age"
+	"github.com/qup42/loghead/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedRecording(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := strings.Replace(storageMeta, `"connectionID"`, `"command":"mysql --password=secret","connectionID"`, 1)
+	events := []string{`[0.5,"o","hello"]`, `[12.25,"o","` + strings.Repeat("x", 100<<10) + `"]`, ""}
+	want := meta + "\n" + strings.Join(events, "\n")
+	start := time.Unix(1735689600, 0)
+
+	for _, compression := range []string{CompressionNone, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			c := types.SSHRecorderConfig{Dir: dir, Compression: compression, Recipients: []string{id.Recipient().String()}, SigningKey: writeSigningKey(t)}
+			rs, err := NewRecordingService(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record(t, rs, meta, events...)
+
+			r := rs.Index.List(RecordingFilter{})[0]
+			if !r.Encrypted || !strings.HasSuffix(r.Path, ".age") || !r.End.Equal(start.Add(12250*time.Millisecond)) || r.Filename() != filepath.Base(r.Path) || r.Command != "" {
+				t.Fatalf(`recording = %+v`, r)
+			}
+			// the command is only part of the encrypted recording
+			if b, err := os.ReadFile(sidecarPath(filepath.Join(dir, r.Path))); err != nil || bytes.Contains(b, []byte("secret")) {
+				t.Fatalf(`sidecar = %s, %s`, b, err)
+			}
+			b, err := os.ReadFile(filepath.Join(dir, r.Path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(b, []byte("hello")) || int64(len(b)) != r.Size {
+				t.Fatalf(`recording is not encrypted`)
+			}
+			// loghead serves the encrypted recording
+			if got := readRecordingBody(t, rs, r.ID); got != string(b) {
+				t.Fatalf(`Open(%s) did not return the encrypted recording`, r.ID)
+			}
+			var dec bytes.Buffer
+			if err := DecryptRecording(&dec, bytes.NewReader(b), r.Path, id); err != nil || dec.String() != want {
+				t.Fatalf(`DecryptRecording() = %q, %s, want %q`, dec.String(), err, want)
+			}
+
+			// indexed from the sidecar
+			rs, err = NewRecordingService(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rr, err := rs.Index.Get(r.ID); err != nil || rr.ConnectionID != r.ConnectionID || !rr.End.Equal(r.End) || !rr.Encrypted {
+				t.Fatalf(`Get(%s) = %+v, %s, want %+v`, r.ID, rr, err, r)
+			}
+			if ok, statuses := verifyStatuses(t, rs); !ok || statuses[r.Path] != VerifyOK {
+				t.Fatalf(`Verify() = %t, %v`, ok, statuses)
+			}
+		})
+	}
+}
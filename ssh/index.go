@@ -0,0 +1,403 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// Recording describes a recorded session.
+type Recording struct {
+	ID           string   `json:"id"`
+	Path         string   `json:"path"`
+	SrcNode      string   `json:"srcNode"`
+	SrcNodeID    string   `json:"srcNodeID"`
+	SrcNodeTags  []string `json:"srcNodeTags,omitempty"`
+	SrcNodeUser  string   `json:"srcNodeUser,omitempty"`
+	SSHUser      string   `json:"sshUser"`
+	LocalUser    string   `json:"localUser"`
+	Command      string   `json:"command,omitempty"`
+	ConnectionID string   `json:"connectionID"`
+	// the uploading node the session was opened on, only known on tsnet listeners
+	TargetNode     string   `json:"targetNode,omitempty"`
+	TargetNodeID   string   `json:"targetNodeID,omitempty"`
+	TargetNodeTags []string `json:"targetNodeTags,omitempty"`
+	// ssh or kubernetes
+	Kind string `json:"kind"`
+	// Kubernetes sessions
+	Cluster     string    `json:"cluster,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Pod         string    `json:"pod,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	SessionType string    `json:"sessionType,omitempty"`
+	Start       time.Time `json:"start"`
+	// zero while the session is recorded
+	End  time.Time `json:"end"`
+	Size int64     `json:"size"`
+	// encrypted recordings cannot be played by loghead
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// Filename returns the name of the uncompressed recording, or of the encrypted file.
+func (r Recording) Filename() string {
+	if r.Encrypted {
+		return path.Base(r.Path)
+	}
+	return strings.TrimSuffix(path.Base(r.Path), zstdExt)
+}
+
+// kinds of recorded sessions
+const (
+	KindSSH        = "ssh"
+	KindKubernetes = "kubernetes"
+)
+
+// RecordingFilter selects recordings. Empty fields match all recordings.
+type RecordingFilter struct {
+	SrcNode      string
+	SrcNodeID    string
+	SrcNodeUser  string
+	SSHUser      string
+	LocalUser    string
+	ConnectionID string
+	TargetNode   string
+	TargetNodeID string
+	// only ssh or kubernetes sessions
+	Kind      string
+	Cluster   string
+	Namespace string
+	Pod       string
+	Container string
+	// substring of the command
+	Command string
+	// recordings that overlap the time range
+	From time.Time
+	To   time.Time
+}
+
+func (f RecordingFilter) matches(r *Recording) bool {
+	eq := func(want, v string) bool { return want == "" || want == v }
+	if !eq(f.SrcNode, r.SrcNode) || !eq(f.SrcNodeID, r.SrcNodeID) || !eq(f.SrcNodeUser, r.SrcNodeUser) ||
+		!eq(f.SSHUser, r.SSHUser) || !eq(f.LocalUser, r.LocalUser) || !eq(f.ConnectionID, r.ConnectionID) ||
+		!eq(f.TargetNode, r.TargetNode) || !eq(f.TargetNodeID, r.TargetNodeID) ||
+		!eq(f.Kind, r.Kind) || !eq(f.Cluster, r.Cluster) || !eq(f.Namespace, r.Namespace) || !eq(f.Pod, r.Pod) || !eq(f.Container, r.Container) {
+		return false
+	}
+	if f.Command != "" && !strings.Contains(r.Command, f.Command) {
+		return false
+	}
+	if !f.To.IsZero() && r.Start.After(f.To) {
+		return false
+	}
+	if !f.From.IsZero() && !r.End.IsZero() && r.End.Before(f.From) {
+		return false
+	}
+	return true
+}
+
+// recordingID derives a stable id from the path of the recording relative to the recordings directory.
+// Compressing a recording does not change its id.
+func recordingID(rel string) string {
+	h := sha256.Sum256([]byte(strings.TrimSuffix(filepath.ToSlash(rel), zstdExt)))
+	return hex.EncodeToString(h[:8])
+}
+
+func newRecording(rel string, meta *CastMetadata) *Recording {
+	r := &Recording{
+		ID:           recordingID(rel),
+		Path:         filepath.ToSlash(rel),
+		SrcNode:      meta.SrcNode,
+		SrcNodeID:    meta.SrcNodeID,
+		SrcNodeTags:  meta.SrcNodeTags,
+		SrcNodeUser:  meta.SrcNodeUser,
+		SSHUser:      meta.SSHUser,
+		LocalUser:    meta.LocalUser,
+		Command:      meta.Command,
+		ConnectionID: meta.ConnectionID,
+		Start:        meta.Timestamp.Time,
+		Encrypted:    strings.HasSuffix(rel, ageExt),
+		Kind:         KindSSH,
+	}
+	// the command is session content, the sidecar of encrypted recordings is not encrypted
+	if r.Encrypted {
+		r.Command = ""
+	}
+	if k := meta.Kubernetes; k != nil {
+		r.Kind = KindKubernetes
+		r.Namespace = k.Namespace
+		r.Pod = k.PodName
+		r.Container = k.Container
+		r.SessionType = k.SessionType
+		// the cluster is only known from the path, kubernetes/<cluster>/<namespace>/<pod>/<recording>
+		if parts := strings.Split(r.Path, "/"); len(parts) == 5 && parts[0] == kubernetesDir {
+			r.Cluster = parts[1]
+		}
+	}
+	return r
+}
+
+// Index keeps the metadata of all recordings in memory.
+type Index struct {
+	mu   sync.RWMutex
+	recs map[string]*Recording
+}
+
+func NewIndex() *Index {
+	return &Index{recs: map[string]*Recording{}}
+}
+
+func (idx *Index) Add(r *Recording) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.recs[r.ID] = r
+}
+
+// Finish records the end time and size of a recording.
+func (idx *Index) Finish(id string, end time.Time, size int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if r, ok := idx.recs[id]; ok {
+		r.End = end
+		r.Size = size
+	}
+}
+
+func (idx *Index) Get(id string) (Recording, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	r, ok := idx.recs[id]
+	if !ok {
+		return Recording{}, ErrRecordingNotFound
+	}
+	return *r, nil
+}
+
+// List returns the matching recordings, the most recent first.
+func (idx *Index) List(f RecordingFilter) []Recording {
+	idx.mu.RLock()
+	rs := []Recording{}
+	for _, r := range idx.recs {
+		if f.matches(r) {
+			rs = append(rs, *r)
+		}
+	}
+	idx.mu.RUnlock()
+	slices.SortFunc(rs, func(a, b Recording) int {
+		if c := b.Start.Compare(a.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	return rs
+}
+
+// Rebuild replaces the index with the recordings found in dir.
+func (idx *Index) Rebuild(dir string) error {
+	recs := map[string]*Recording{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isRecording(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		r, err := readRecording(p, rel)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Skipping recording %s", p)
+			return nil
+		}
+		// prefer the compressed recording if the migration was interrupted
+		if prev, ok := recs[r.ID]; ok && strings.HasSuffix(prev.Path, zstdExt) {
+			return nil
+		}
+		recs[r.ID] = r
+		return nil
+	})
+	if err != nil {
+		return errors.Errorf("indexing recordings: %w", err)
+	}
+	idx.mu.Lock()
+	idx.recs = recs
+	idx.mu.Unlock()
+	log.Info().Msgf("Indexed %d recordings in %s", len(recs), dir)
+	return nil
+}
+
+// readRecording reads the metadata of a recording file.
+func readRecording(p string, rel string) (*Recording, error) {
+	if strings.HasSuffix(p, ageExt) {
+		return readEncryptedRecording(p, rel)
+	}
+	// recordings that were interrupted have no end in their sidecar
+	if r, err := readSidecar(p, rel); err == nil && !r.End.IsZero() {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		r.Size = fi.Size()
+		return r, nil
+	}
+	if strings.HasSuffix(p, zstdExt) {
+		return readCompressedRecording(p, rel)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b, err := readSingleUntil(f, []byte("\n"))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	meta, err := readCastMetadata(b)
+	if err != nil {
+		return nil, err
+	}
+	r := newRecording(rel, meta)
+	r.Size = fi.Size()
+	elapsed, err := lastEventTime(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	r.End = r.Start.Add(elapsed)
+	return r, nil
+}
+
+// readCompressedRecording reads the metadata of a compressed recording file.
+// The end of a compressed recording cannot be read directly, the whole recording is decompressed instead.
+func readCompressedRecording(p string, rel string) (*Recording, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openRecordingFile(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := readSingleUntil(f, []byte("\n"))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	meta, err := readCastMetadata(b)
+	if err != nil {
+		return nil, err
+	}
+	r := newRecording(rel, meta)
+	r.Size = fi.Size()
+	var events eventTracker
+	// the header was consumed already
+	events.pastHeader = true
+	// recordings that were interrupted end with an incomplete frame
+	if _, err := io.Copy(&events, f); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Warn().Err(err).Msgf("Reading recording %s", p)
+	}
+	events.endLine()
+	r.End = r.Start.Add(events.last)
+	return r, nil
+}
+
+// readEncryptedRecording reads the metadata of an encrypted recording from its sidecar.
+func readEncryptedRecording(p string, rel string) (*Recording, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	r, err := readSidecar(p, rel)
+	if err != nil {
+		return nil, err
+	}
+	r.Size = fi.Size()
+	return r, nil
+}
+
+// extension of the metadata file that is stored next to each recording
+const sidecarExt = ".json"
+
+// sidecarPath returns the path of the metadata of the recording at p.
+// Compressing a recording keeps its sidecar.
+func sidecarPath(p string) string {
+	return strings.TrimSuffix(p, zstdExt) + sidecarExt
+}
+
+// writeSidecar saves the metadata of a recording next to it, so that it can be indexed without reading the recording.
+func writeSidecar(p string, r Recording) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Errorf("encoding recording metadata: %w", err)
+	}
+	tmp := sidecarPath(p) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Errorf("writing recording metadata: %w", err)
+	}
+	if err := os.Rename(tmp, sidecarPath(p)); err != nil {
+		return errors.Errorf("writing recording metadata: %w", err)
+	}
+	return nil
+}
+
+// readSidecar reads the metadata of a recording.
+func readSidecar(p string, rel string) (*Recording, error) {
+	b, err := os.ReadFile(sidecarPath(p))
+	if err != nil {
+		return nil, errors.Errorf("reading recording metadata: %w", err)
+	}
+	var r Recording
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Errorf("reading recording metadata: %w", err)
+	}
+	// the recording may have been moved
+	r.ID = recordingID(rel)
+	r.Path = filepath.ToSlash(rel)
+	r.Encrypted = strings.HasSuffix(rel, ageExt)
+	return &r, nil
+}
+
+// the last event is searched for in this many bytes at the end of the recording
+const lastEventWindow = 64 << 10
+
+// lastEventTime returns the time of the last complete event of the recording,
+// relative to the start of the recording.
+func lastEventTime(f io.ReaderAt, size int64) (time.Duration, error) {
+	off := max(size-lastEventWindow, 0)
+	b := make([]byte, size-off)
+	if _, err := f.ReadAt(b, off); err != nil && !errors.Is(err, io.EOF) {
+		return 0, errors.Errorf("reading end of recording: %w", err)
+	}
+	lines := bytes.Split(b, []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		// events are arrays of [time, code, data]
+		var ev []json.RawMessage
+		if json.Unmarshal(lines[i], &ev) != nil || len(ev) == 0 {
+			continue
+		}
+		var t float64
+		if json.Unmarshal(ev[0], &t) != nil {
+			continue
+		}
+		return time.Duration(t * float64(time.Second)), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,181 @@
+package ssh
+
+import (
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"github.com/qup42/loghead/types"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func record(t *testing.T, rs *RecordingService, meta string, events ...string) {
+	t.Helper()
+	body := meta + "\n" + strings.Join(events, "\n")
+	if err := rs.Record(io.NopCloser(strings.NewReader(body)), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, rs, `{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","srcNodeTags":["tag:admin"],"sshUser":"root","localUser":"root","connectionID":"c1"}`,
+		`[0.5,"o","hello"]`, `[12.25,"o","bye"]`, "")
+	record(t, rs, `{"version":2,"timestamp":1735693200,"command":"uptime","srcNode":"desktop","srcNodeID":"n2","sshUser":"alice","localUser":"alice","connectionID":"c2"}`,
+		`[1,"o","up 3 days"]`)
+
+	// rebuilt from disk
+	idx := NewIndex()
+	if err := idx.Rebuild(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, idx := range map[string]*Index{"recorded": rs.Index, "rebuilt": idx} {
+		t.Run(name, func(t *testing.T) {
+			all := idx.List(RecordingFilter{})
+			if len(all) != 2 || all[0].ConnectionID != "c2" || all[1].ConnectionID != "c1" {
+				t.Fatalf(`List() = %+v, want c2 and c1`, all)
+			}
+			first := all[1]
+			start := time.Unix(1735689600, 0)
+			if !first.Start.Equal(start) || !first.End.Equal(start.Add(12250*time.Millisecond)) || first.Size == 0 ||
+				first.SrcNodeTags[0] != "tag:admin" || first.Path != "n1/"+start.Format(time.RFC3339)+".cast" {
+				t.Fatalf(`recording = %+v`, first)
+			}
+			if r, err := idx.Get(first.ID); err != nil || r.ConnectionID != "c1" {
+				t.Fatalf(`Get(%s) = %+v, %s`, first.ID, r, err)
+			}
+
+			tests := []struct {
+				name   string
+				filter RecordingFilter
+				want   []string
+			}{
+				{name: "ssh user", filter: RecordingFilter{SSHUser: "alice"}, want: []string{"c2"}},
+				{name: "src node", filter: RecordingFilter{SrcNode: "laptop"}, want: []string{"c1"}},
+				{name: "command", filter: RecordingFilter{Command: "up"}, want: []string{"c2"}},
+				{name: "from", filter: RecordingFilter{From: start.Add(time.Minute)}, want: []string{"c2"}},
+				{name: "to", filter: RecordingFilter{To: start.Add(time.Minute)}, want: []string{"c1"}},
+				{name: "overlap", filter: RecordingFilter{From: start.Add(10 * time.Second), To: start.Add(11 * time.Second)}, want: []string{"c1"}},
+				{name: "none", filter: RecordingFilter{LocalUser: "bob"}, want: []string{}},
+			}
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					got := []string{}
+					for _, r := range idx.List(tc.filter) {
+						got = append(got, r.ConnectionID)
+					}
+					if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+						t.Fatalf(`List(%+v) = %v, want %v`, tc.filter, got, tc.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","sshUser":"root","localUser":"root","connectionID":"c1"}`
+	record(t, rs, meta, `[0.5,"o","hello"]`)
+
+	r := rs.Index.List(RecordingFilter{})[0]
+	f, _, err := rs.Open(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != meta+"\n"+`[0.5,"o","hello"]` {
+		t.Fatalf(`Open(%s) = %q, %s`, r.ID, b, err)
+	}
+	if _, _, err := rs.Open("0000"); !errors.Is(err, ErrRecordingNotFound) {
+		t.Fatalf(`Open("0000") = %s, want %s`, err, ErrRecordingNotFound)
+	}
+}
+
+func TestKubernetesRecording(t *testing.T) {
+	dir := t.TempDir()
+	rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: dir, KubernetesCluster: "prod-eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header as written by the Tailscale Kubernetes operator
+	record(t, rs, `{"version":2,"width":0,"height":0,"timestamp":1735689600,"command":"sh","srcNode":"laptop.tail1234.ts.net","srcNodeID":"n1","srcNodeUserID":42,"srcNodeUser":"alice@example.com","env":null,"sshUser":"","localUser":"","connectionID":"","kubernetes":{"PodName":"web-0","Namespace":"shop","Container":"app","SessionType":"exec"}}`,
+		`[0.5,"o","# "]`, "")
+	record(t, rs, `{"version":2,"timestamp":1735693200,"srcNode":"desktop","srcNodeID":"n2","sshUser":"root","localUser":"root","connectionID":"c2"}`,
+		`[1,"o","hello"]`, "")
+
+	idx := NewIndex()
+	if err := idx.Rebuild(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, idx := range map[string]*Index{"recorded": rs.Index, "rebuilt": idx} {
+		t.Run(name, func(t *testing.T) {
+			rs := idx.List(RecordingFilter{Kind: KindKubernetes})
+			if len(rs) != 1 {
+				t.Fatalf(`List() = %+v, want 1 recording`, rs)
+			}
+			r := rs[0]
+			if r.Path != "kubernetes/prod-eu/shop/web-0/2025-01-01T00:00:00Z.cast" || r.Cluster != "prod-eu" || r.Namespace != "shop" ||
+				r.Pod != "web-0" || r.Container != "app" || r.SessionType != "exec" || r.SrcNodeUser != "alice@example.com" || r.Command != "sh" {
+				t.Fatalf(`recording = %+v`, r)
+			}
+
+			tests := []struct {
+				name   string
+				filter RecordingFilter
+				want   int
+			}{
+				{name: "all", filter: RecordingFilter{}, want: 2},
+				{name: "ssh", filter: RecordingFilter{Kind: KindSSH}, want: 1},
+				{name: "cluster", filter: RecordingFilter{Cluster: "prod-eu"}, want: 1},
+				{name: "namespace", filter: RecordingFilter{Namespace: "shop", Pod: "web-0", Container: "app"}, want: 1},
+				{name: "other namespace", filter: RecordingFilter{Namespace: "default"}, want: 0},
+			}
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					if got := idx.List(tc.filter); len(got) != tc.want {
+						t.Fatalf(`List(%+v) = %+v, want %d recordings`, tc.filter, got, tc.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestKubernetesRecordingInvalidName(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		pod       string
+	}{
+		{name: "empty namespace", namespace: "", pod: "web-0"},
+		{name: "empty pod", namespace: "shop", pod: ""},
+		{name: "traversal", namespace: "../n1", pod: "web-0"},
+		{name: "upper case", namespace: "shop", pod: "Web-0"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the session is recorded and named like SSH sessions
+			record(t, rs, fmt.Sprintf(`{"version":2,"timestamp":1735689600,"srcNodeID":"n3","kubernetes":{"PodName":%q,"Namespace":%q}}`, tc.pod, tc.namespace),
+				`[0.5,"o","# "]`)
+			recs := rs.Index.List(RecordingFilter{Kind: KindKubernetes})
+			if len(recs) != 1 || recs[0].Path != "n3/2025-01-01T00:00:00Z.cast" {
+				t.Fatalf(`List() = %+v, want n3/2025-01-01T00:00:00Z.cast`, recs)
+			}
+		})
+	}
+}
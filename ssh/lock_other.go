@@ -0,0 +1,12 @@
+//go:build !unix
+
+package ssh
+
+import (
+	"os"
+)
+
+// lockFile is not supported, recordings without an end are never compressed then.
+func lockFile(f *os.File) error {
+	return errLockUnsupported
+}
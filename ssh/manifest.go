@@ -0,0 +1,297 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/cockroachdb/errors"
+	"github.com/qup42/loghead/util"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// manifests are kept in this directory below the recordings directory, one file per day
+const manifestDir = "manifests"
+
+// Manifest records the contents of a completed recording.
+type Manifest struct {
+	ID string `json:"id"`
+	// path of the uncompressed recording relative to the recordings directory
+	Path string `json:"path"`
+	// size and SHA-256 of the uncompressed recording, or of the file if the recording is encrypted
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Completed time.Time `json:"completed"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	// SHA-256 of the previous line of the chain, empty for the first manifest
+	Prev string `json:"prev"`
+}
+
+// signedManifest is a line of a manifest file.
+// The signature covers the exact bytes of the manifest.
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature []byte          `json:"signature"`
+}
+
+// ReadSigningKey reads an ed25519 private key in PKCS #8 PEM format, as created by `openssl genpkey -algorithm ed25519`.
+func ReadSigningKey(p string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, errors.Errorf("reading signing key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.Errorf("signing key %s is not PEM encoded", p)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Errorf("parsing signing key: %w", err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("signing key %s is a %T, not an ed25519 key", p, k)
+	}
+	return key, nil
+}
+
+// ManifestChain appends signed manifests to per day files.
+// Each manifest contains the hash of the previous one, also across days,
+// so that removing or altering a manifest breaks the chain.
+type ManifestChain struct {
+	Dir string
+	key ed25519.PrivateKey
+
+	mu   sync.Mutex
+	prev string
+}
+
+func NewManifestChain(dir string, key ed25519.PrivateKey) (*ManifestChain, error) {
+	mc := &ManifestChain{Dir: filepath.Join(dir, manifestDir), key: key}
+	if err := util.EnsureFolderExists(mc.Dir); err != nil {
+		return nil, errors.Errorf("creating manifest directory: %w", err)
+	}
+	files, err := manifestFiles(mc.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// continue the chain after the last manifest
+	for i := len(files) - 1; i >= 0 && mc.prev == ""; i-- {
+		lines, err := readManifestLines(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) > 0 {
+			mc.prev = lineHash(lines[len(lines)-1])
+		}
+	}
+	return mc, nil
+}
+
+func (mc *ManifestChain) PublicKey() ed25519.PublicKey {
+	return mc.key.Public().(ed25519.PublicKey)
+}
+
+// Append signs the manifest and appends it to the file of the day it was completed.
+func (mc *ManifestChain) Append(m Manifest) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	m.Prev = mc.prev
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Errorf("encoding manifest: %w", err)
+	}
+	line, err := json.Marshal(signedManifest{Manifest: b, Signature: ed25519.Sign(mc.key, b)})
+	if err != nil {
+		return errors.Errorf("encoding manifest: %w", err)
+	}
+	p := filepath.Join(mc.Dir, m.Completed.UTC().Format(time.DateOnly)+".jsonl")
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Errorf("opening manifest file: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		return errors.Errorf("writing manifest: %w", err)
+	}
+	mc.prev = lineHash(line)
+	return nil
+}
+
+func lineHash(line []byte) string {
+	h := sha256.Sum256(line)
+	return hex.EncodeToString(h[:])
+}
+
+// manifestFiles returns the manifest files in chain order.
+func manifestFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, errors.Errorf("listing manifests: %w", err)
+	}
+	// the files are named after the day
+	slices.Sort(files)
+	return files, nil
+}
+
+func readManifestLines(p string) ([][]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Errorf("reading manifests: %w", err)
+	}
+	defer f.Close()
+	var lines [][]byte
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) > 0 {
+			lines = append(lines, bytes.Clone(s.Bytes()))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Errorf("reading manifests %s: %w", p, err)
+	}
+	return lines, nil
+}
+
+// verification results
+const (
+	VerifyOK = "ok"
+	// recordings that were not completed while signing was enabled
+	VerifyUnsigned = "unsigned"
+	// recordings without a manifest that started after the first manifest, e.g. because manifests were removed
+	VerifyMissingManifest  = "missing_manifest"
+	VerifyModified         = "modified"
+	VerifyTruncated        = "truncated"
+	VerifyMissing          = "missing"
+	VerifyInvalidManifest  = "invalid_manifest"
+	VerifyInvalidSignature = "invalid_signature"
+	// manifests before this one were removed, altered or reordered
+	VerifyBrokenChain = "broken_chain"
+)
+
+type VerifyResult struct {
+	ID     string `json:"id,omitempty"`
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type VerifyReport struct {
+	// whether all recordings and manifests are intact, unsigned recordings are allowed
+	OK        bool           `json:"ok"`
+	Manifests int            `json:"manifests"`
+	Results   []VerifyResult `json:"results"`
+}
+
+// Verify checks the manifest chain and compares the recordings to their manifests.
+func (rec *RecordingService) Verify() (VerifyReport, error) {
+	if rec.Manifests == nil {
+		return VerifyReport{}, errors.New("signing of recordings is not configured")
+	}
+	pub := rec.Manifests.PublicKey()
+	files, err := manifestFiles(rec.Manifests.Dir)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	report := VerifyReport{OK: true, Results: []VerifyResult{}}
+	add := func(r VerifyResult) {
+		if r.Status != VerifyOK && r.Status != VerifyUnsigned {
+			report.OK = false
+		}
+		report.Results = append(report.Results, r)
+	}
+
+	signed := map[string]bool{}
+	// start of the first signed recording
+	var first time.Time
+	prev := ""
+	for _, p := range files {
+		lines, err := readManifestLines(p)
+		if err != nil {
+			return VerifyReport{}, err
+		}
+		for i, line := range lines {
+			report.Manifests++
+			// the chain continues after invalid lines
+			h := lineHash(line)
+			var sm signedManifest
+			var m Manifest
+			if err := json.Unmarshal(line, &sm); err != nil || json.Unmarshal(sm.Manifest, &m) != nil {
+				add(VerifyResult{Path: filepath.Base(p) + ":" + strconv.Itoa(i+1), Status: VerifyInvalidManifest})
+				prev = h
+				continue
+			}
+			signed[m.ID] = true
+			if first.IsZero() {
+				first = m.Start
+			}
+			switch {
+			case !ed25519.Verify(pub, sm.Manifest, sm.Signature):
+				add(VerifyResult{ID: m.ID, Path: m.Path, Status: VerifyInvalidSignature})
+			case m.Prev != prev:
+				add(VerifyResult{ID: m.ID, Path: m.Path, Status: VerifyBrokenChain})
+			default:
+				add(rec.verifyRecording(m))
+			}
+			prev = h
+		}
+	}
+
+	for _, r := range rec.Index.List(RecordingFilter{}) {
+		// recordings that are still recorded have no manifest yet
+		if signed[r.ID] || r.End.IsZero() {
+			continue
+		}
+		if !first.IsZero() && !r.Start.Before(first) {
+			add(VerifyResult{ID: r.ID, Path: r.Path, Status: VerifyMissingManifest})
+			continue
+		}
+		add(VerifyResult{ID: r.ID, Path: r.Path, Status: VerifyUnsigned})
+	}
+	return report, nil
+}
+
+// verifyRecording compares a recording to its manifest.
+func (rec *RecordingService) verifyRecording(m Manifest) VerifyResult {
+	res := VerifyResult{ID: m.ID, Path: m.Path, Status: VerifyOK}
+	f, err := rec.openRecordingPath(m.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		res.Status = VerifyMissing
+		return res
+	}
+	if err != nil {
+		res.Status = VerifyModified
+		res.Error = err.Error()
+		return res
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	switch {
+	case n < m.Size:
+		res.Status = VerifyTruncated
+	case err != nil:
+		res.Status = VerifyModified
+		res.Error = err.Error()
+	case n != m.Size || hex.EncodeToString(h.Sum(nil)) != m.SHA256:
+		res.Status = VerifyModified
+	}
+	return res
+}
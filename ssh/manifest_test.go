@@ -0,0 +1,133 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/qup42/loghead/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSigningKey(t *testing.T) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func verifyStatuses(t *testing.T, rs *RecordingService) (bool, map[string]string) {
+	t.Helper()
+	report, err := rs.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, r := range report.Results {
+		statuses[r.Path] = r.Status
+	}
+	return report.OK, statuses
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	c := types.SSHRecorderConfig{Dir: dir, SigningKey: writeSigningKey(t)}
+	unsigned, err := NewRecordingService(types.SSHRecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, unsigned, `{"version":2,"timestamp":1735686000,"srcNodeID":"n0","connectionID":"c0"}`, `[1,"o","a"]`, "")
+
+	rs, err := NewRecordingService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		record(t, rs, `{"version":2,"timestamp":1735689600,"srcNodeID":"`+id+`","connectionID":"c1"}`, `[1,"o","hello"]`, `[2,"o","bye"]`, "")
+	}
+	// the chain is continued after a restart
+	rs, err = NewRecordingService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, rs, `{"version":2,"timestamp":1735689600,"srcNodeID":"n4","connectionID":"c1"}`, `[1,"o","hello"]`, "")
+
+	ok, statuses := verifyStatuses(t, rs)
+	if !ok || len(statuses) != 5 || statuses["n0/2024-12-31T23:00:00Z.cast"] != VerifyUnsigned ||
+		statuses["n1/2025-01-01T00:00:00Z.cast"] != VerifyOK || statuses["n4/2025-01-01T00:00:00Z.cast"] != VerifyOK {
+		t.Fatalf(`Verify() = %t, %v`, ok, statuses)
+	}
+
+	tamper := func(rel string, f func(b []byte) []byte) {
+		p := filepath.Join(dir, rel)
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, f(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tamper("n1/2025-01-01T00:00:00Z.cast", func(b []byte) []byte { return bytes.Replace(b, []byte("bye"), []byte("hi!"), 1) })
+	tamper("n2/2025-01-01T00:00:00Z.cast", func(b []byte) []byte { return b[:len(b)-5] })
+	if err := os.Remove(filepath.Join(dir, "n3/2025-01-01T00:00:00Z.cast")); err != nil {
+		t.Fatal(err)
+	}
+	ok, statuses = verifyStatuses(t, rs)
+	want := map[string]string{
+		"n0/2024-12-31T23:00:00Z.cast": VerifyUnsigned,
+		"n1/2025-01-01T00:00:00Z.cast": VerifyModified,
+		"n2/2025-01-01T00:00:00Z.cast": VerifyTruncated,
+		"n3/2025-01-01T00:00:00Z.cast": VerifyMissing,
+		"n4/2025-01-01T00:00:00Z.cast": VerifyOK,
+	}
+	for p, s := range want {
+		if statuses[p] != s {
+			t.Fatalf(`Verify() = %t, %v, want %v`, ok, statuses, want)
+		}
+	}
+	if ok {
+		t.Fatal(`Verify() = true, want false`)
+	}
+
+	// remove the manifest of n2 and alter the one of n3
+	files, err := manifestFiles(rs.Manifests.Dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf(`manifestFiles() = %v, %s`, files, err)
+	}
+	tamper(filepath.Join(manifestDir, filepath.Base(files[0])), func(b []byte) []byte {
+		lines := strings.Split(string(b), "\n")
+		lines[2] = strings.Replace(lines[2], `"size":`, `"size":1`, 1)
+		return []byte(strings.Join(append(lines[:1], lines[2:]...), "\n"))
+	})
+	_, statuses = verifyStatuses(t, rs)
+	if statuses["n2/2025-01-01T00:00:00Z.cast"] != VerifyMissingManifest || statuses["n3/2025-01-01T00:00:00Z.cast"] != VerifyInvalidSignature ||
+		statuses["n4/2025-01-01T00:00:00Z.cast"] != VerifyBrokenChain {
+		t.Fatalf(`Verify() = %v`, statuses)
+	}
+}
+
+func TestVerifyCompressed(t *testing.T) {
+	dir := t.TempDir()
+	rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: dir, Compression: CompressionZstd, SigningKey: writeSigningKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, rs, storageMeta, `[1,"o","hello"]`, "")
+	if ok, statuses := verifyStatuses(t, rs); !ok || statuses["n1/2025-01-01T00:00:00Z.cast"] != VerifyOK {
+		t.Fatalf(`Verify() = %t, %v`, ok, statuses)
+	}
+}
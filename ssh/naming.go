@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/cockroachdb/errors"
+	"github.com/qup42/loghead/types"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultNaming stores recordings in a directory per source node, named after the start of the session.
+const DefaultNaming = "{{.SrcNodeID}}/{{.Timestamp}}"
+
+// after this many numbered names a random suffix is used
+const maxNameSuffix = 100
+
+// NameData is passed to the naming template of recordings.
+type NameData struct {
+	// start of the session in RFC 3339 format
+	Timestamp string
+	// start of the session, for custom formats like {{.Time.Format "2006/01/02"}}
+	Time         time.Time
+	SrcNode      string
+	SrcNodeID    string
+	SrcNodeUser  string
+	SSHUser      string
+	LocalUser    string
+	ConnectionID string
+	// the node the session was opened on, empty unless the listener is a tsnet listener
+	TargetNode   string
+	TargetNodeID string
+}
+
+func newNameData(meta *CastMetadata, target *types.PeerIdentity) NameData {
+	d := NameData{
+		Timestamp:    meta.Timestamp.Format(time.RFC3339),
+		Time:         meta.Timestamp.Time,
+		SrcNode:      meta.SrcNode,
+		SrcNodeID:    meta.SrcNodeID,
+		SrcNodeUser:  meta.SrcNodeUser,
+		SSHUser:      meta.SSHUser,
+		LocalUser:    meta.LocalUser,
+		ConnectionID: meta.ConnectionID,
+	}
+	if target != nil {
+		d.TargetNode = target.NodeName
+		d.TargetNodeID = target.NodeID
+	}
+	return d
+}
+
+// parseNaming parses and checks a naming template.
+func parseNaming(s string) (*template.Template, error) {
+	if s == "" {
+		s = DefaultNaming
+	}
+	tmpl, err := template.New("naming").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, errors.Errorf("parsing naming template: %w", err)
+	}
+	sample := &CastMetadata{Timestamp: UnixTime{time.Now()}, SrcNodeID: "n1", ConnectionID: "c1"}
+	if _, err := executeNaming(tmpl, newNameData(sample, nil)); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// executeNaming returns the path of a recording without extension, relative to the recordings directory.
+func executeNaming(tmpl *template.Template, data NameData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", errors.Errorf("executing naming template: %w", err)
+	}
+	var parts []string
+	for _, p := range strings.Split(b.String(), "/") {
+		// empty fields do not create directories
+		if p = sanitizeName(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return "", errors.Errorf("naming template %q results in an empty name", tmpl.Root.String())
+	}
+	return path.Join(parts...), nil
+}
+
+var unsafeNameRe = regexp.MustCompile(`[^A-Za-z0-9._:@+=-]`)
+
+// sanitizeName turns a value of the metadata into a safe file or directory name.
+func sanitizeName(s string) string {
+	s = unsafeNameRe.ReplaceAllString(strings.TrimSpace(s), "_")
+	if strings.Trim(s, ".") == "" && s != "" {
+		return strings.Repeat("_", len(s))
+	}
+	return s
+}
+
+// createRecordingFile creates a new recording file for the path without extension.
+// If a recording with that name exists already, -1, -2, ... and finally a random suffix is appended to the name.
+// The returned path is relative to the recordings directory.
+func (rec *RecordingService) createRecordingFile(name string, ext string) (*os.File, string, error) {
+	for i := 0; ; i++ {
+		rel := name
+		switch {
+		case i > maxNameSuffix:
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err != nil {
+				return nil, "", err
+			}
+			rel += "-" + hex.EncodeToString(b)
+		case i > 0:
+			rel += "-" + strconv.Itoa(i)
+		}
+		rel += ext
+		// a recording that was compressed since has the same id
+		if _, err := rec.Index.Get(recordingID(rel)); err == nil {
+			continue
+		}
+		p := filepath.Join(rec.Dir, filepath.FromSlash(rel))
+		// os.O_CREATE|os.O_EXCL ensures that no recordings are overwriten
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) && i <= maxNameSuffix*2 {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return f, rel, nil
+	}
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"github.com/qup42/loghead/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExecuteNaming(t *testing.T) {
+	meta := &CastMetadata{Timestamp: UnixTime{}, SrcNode: "laptop", SrcNodeID: "n1", SSHUser: "root", LocalUser: "alice", ConnectionID: "c1"}
+	tests := []struct {
+		name    string
+		naming  string
+		sshUser string
+		target  *types.PeerIdentity
+		want    string
+	}{
+		{name: "default", naming: "", sshUser: "root", want: "n1/" + meta.Timestamp.Format(time.RFC3339)},
+		{name: "fields", naming: "{{.SrcNode}}/{{.LocalUser}}/{{.ConnectionID}}", sshUser: "root", want: "laptop/alice/c1"},
+		{name: "time", naming: `{{.Time.Format "2006/01"}}/{{.ConnectionID}}`, sshUser: "root", want: meta.Timestamp.Format("2006/01") + "/c1"},
+		{name: "traversal", naming: "{{.SSHUser}}/{{.ConnectionID}}", sshUser: "../..", want: "__/__/c1"},
+		{name: "unsafe", naming: "{{.SSHUser}}-{{.ConnectionID}}", sshUser: "a b\\c*", want: "a_b_c_-c1"},
+		{name: "empty field", naming: "{{.SrcNodeUser}}/{{.ConnectionID}}", sshUser: "root", want: "c1"},
+		{name: "target", naming: "{{.TargetNodeID}}/{{.TargetNode}}-{{.ConnectionID}}", sshUser: "root", target: &types.PeerIdentity{NodeName: "server.tail1234.ts.net", NodeID: "n9"}, want: "n9/server.tail1234.ts.net-c1"},
+		{name: "unknown target", naming: `{{or .TargetNodeID "unknown"}}/{{.ConnectionID}}`, sshUser: "root", want: "unknown/c1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := parseNaming(tc.naming)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := *meta
+			m.SSHUser = tc.sshUser
+			if got, err := executeNaming(tmpl, newNameData(&m, tc.target)); err != nil || got != tc.want {
+				t.Fatalf(`executeNaming(%q) = %q, %s, want %q`, tc.naming, got, err, tc.want)
+			}
+		})
+	}
+
+	for _, naming := range []string{"{{.Target}}", "{{.SrcNodeUser}}", "{{"} {
+		if _, err := parseNaming(naming); err == nil {
+			t.Fatalf(`parseNaming(%q) succeeded`, naming)
+		}
+	}
+}
+
+func TestRecordingNameCollision(t *testing.T) {
+	dir := t.TempDir()
+	c := types.SSHRecorderConfig{Dir: dir}
+	rs, err := NewRecordingService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sessions of the same node started in the same second
+	for range 3 {
+		record(t, rs, storageMeta, `[1,"o","hello"]`, "")
+	}
+	// the first recording was compressed since
+	if _, err := CompressRecordings(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	rs, err = NewRecordingService(types.SSHRecorderConfig{Dir: dir, Compression: CompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, rs, storageMeta, `[1,"o","hello"]`, "")
+
+	var got []string
+	for _, r := range rs.Index.List(RecordingFilter{}) {
+		got = append(got, r.Path)
+		if _, err := os.Stat(sidecarPath(filepath.Join(dir, r.Path))); err != nil {
+			t.Fatalf(`sidecar of %s: %s`, r.Path, err)
+		}
+	}
+	want := []string{
+		"n1/2025-01-01T00:00:00Z-1.cast.zst",
+		"n1/2025-01-01T00:00:00Z-2.cast.zst",
+		"n1/2025-01-01T00:00:00Z-3.cast.zst",
+		"n1/2025-01-01T00:00:00Z.cast.zst",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf(`List() = %v, want %v`, got, want)
+	}
+}
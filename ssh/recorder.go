@@ -3,18 +3,34 @@ package ssh
 import (
 	"bytes"
 	"encoding/json"
+	"filippo.io/age"
 	"fmt"
 	"github.com/cockroachdb/errors"
 	"github.com/qup42/loghead/types"
 	"github.com/qup42/loghead/util"
+	"github.com/rs/zerolog/log"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
 	"time"
 )
 
 type RecordingService struct {
-	Dir string
+	Dir         string
+	Compression string
+	Index       *Index
+	// name of the cluster of Kubernetes sessions
+	KubernetesCluster string
+	// nil if signing is disabled
+	Manifests *ManifestChain
+	// recordings are encrypted to these recipients, if any
+	Recipients []age.Recipient
+	// names SSH session recordings, see NameData
+	Naming *template.Template
 }
 
 // See https://docs.asciinema.org/manual/asciicast/v2/
@@ -27,12 +43,24 @@ type CastMetadata struct {
 	Command       string   `json:"command,omitempty"`
 	SrcNode       string   `json:"srcNode"`
 	SrcNodeID     string   `json:"srcNodeID"`
-	SrcNodeTags   string   `json:"srcNodeTags,omitempty"`
+	SrcNodeTags   []string `json:"srcNodeTags,omitempty"`
 	SrcNodeUser   string   `json:"srcNodeUser,omitempty"`
 	SrcNodeUserID int64    `json:"srcNodeUserID,omitempty"`
 	SSHUser       string   `json:"sshUser"`
 	LocalUser     string   `json:"localUser"`
 	ConnectionID  string   `json:"connectionID"`
+	// only set for sessions recorded by the Tailscale Kubernetes operator
+	Kubernetes *KubernetesMetadata `json:"kubernetes,omitempty"`
+}
+
+// KubernetesMetadata describes a `kubectl exec` or `kubectl attach` session.
+// See https://github.com/tailscale/tailscale/blob/main/sessionrecording/header.go
+// The operator does not send the cluster, and the Kubernetes user is the tailnet user or tags of the source node.
+type KubernetesMetadata struct {
+	PodName     string
+	Namespace   string
+	Container   string
+	SessionType string
 }
 
 // Taken from https://ikso.us/posts/unmarshal-timestamp-as-time/
@@ -59,10 +87,60 @@ func NewRecordingService(c types.SSHRecorderConfig) (*RecordingService, error) {
 	if err != nil {
 		return nil, errors.Errorf("init SSHRecorder: %w", err)
 	}
-	return &RecordingService{c.Dir}, nil
+	switch c.Compression {
+	case "", CompressionNone, CompressionZstd:
+	default:
+		return nil, errors.Errorf("init SSHRecorder: unknown compression %q", c.Compression)
+	}
+	cluster := c.KubernetesCluster
+	if cluster == "" {
+		cluster = "default"
+	}
+	if !isValidName(cluster) {
+		return nil, errors.Errorf("init SSHRecorder: invalid kubernetes cluster name %q", cluster)
+	}
+	rec := &RecordingService{Dir: c.Dir, Compression: c.Compression, KubernetesCluster: cluster, Index: NewIndex()}
+	rec.Naming, err = parseNaming(c.Naming)
+	if err != nil {
+		return nil, errors.Errorf("init SSHRecorder: %w", err)
+	}
+	rec.Recipients, err = ParseRecipients(c.Recipients)
+	if err != nil {
+		return nil, errors.Errorf("init SSHRecorder: %w", err)
+	}
+	if c.SigningKey != "" {
+		key, err := ReadSigningKey(c.SigningKey)
+		if err != nil {
+			return nil, errors.Errorf("init SSHRecorder: %w", err)
+		}
+		rec.Manifests, err = NewManifestChain(c.Dir, key)
+		if err != nil {
+			return nil, errors.Errorf("init SSHRecorder: %w", err)
+		}
+	}
+	err = rec.Index.Rebuild(c.Dir)
+	if err != nil {
+		return nil, errors.Errorf("init SSHRecorder: %w", err)
+	}
+	return rec, nil
 }
 
-func (rec *RecordingService) Record(s io.ReadCloser) error {
+// Record writes the recording streamed in s.
+// target is the tailnet identity of the uploading node, the node the session was opened on.
+// It is nil unless the listener is a tsnet listener.
+func (rec *RecordingService) Record(s io.ReadCloser, target *types.PeerIdentity) error {
+	return rec.record(s, target, 0, nil)
+}
+
+// RecordWithAcks writes the recording streamed in s like Record.
+// Every interval the recording is synced to disk and ack is called with the number of bytes of s that are durably written.
+// Once the recording is complete, ack is called with the size of the whole recording.
+// If syncing or ack fail, s is closed to abort the recording.
+func (rec *RecordingService) RecordWithAcks(s io.ReadCloser, target *types.PeerIdentity, interval time.Duration, ack func(int64) error) error {
+	return rec.record(s, target, interval, ack)
+}
+
+func (rec *RecordingService) record(s io.ReadCloser, target *types.PeerIdentity, interval time.Duration, ack func(int64) error) (err error) {
 	// the metadata is the first line
 	b, err := readSingleUntil(s, []byte("\n"))
 	if err != nil {
@@ -72,35 +150,190 @@ func (rec *RecordingService) Record(s io.ReadCloser) error {
 	if err != nil {
 		return errors.Errorf("reading recording metadata: %w", err)
 	}
-	// use the accesing node's stable node id,
-	// tailscale instead uses the target's stable node id
-	// https://tailscale.com/kb/1246/tailscale-ssh-session-recording?q=.cast#session-recordings
-	recDir := path.Join(rec.Dir, meta.SrcNodeID)
-	err = util.EnsureFolderExists(recDir)
+	name, err := rec.recordingName(meta, target)
+	if err != nil {
+		return errors.Errorf("reading recording metadata: %w", err)
+	}
+	err = util.EnsureFolderExists(filepath.Join(rec.Dir, filepath.FromSlash(path.Dir(name))))
 	if err != nil {
 		return errors.Errorf("creating recording directory: %w", err)
 	}
-	recP := path.Join(recDir, meta.Timestamp.Format(time.RFC3339)+".cast")
-	// os.O_CREATE|os.O_EXCL ensures that no recordings are overwriten
-	f, err := os.OpenFile(recP, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	ext := ".cast"
+	if rec.Compression == CompressionZstd {
+		ext += zstdExt
+	}
+	if len(rec.Recipients) > 0 {
+		ext += ageExt
+	}
+	f, rel, err := rec.createRecordingFile(name, ext)
+	if err != nil {
+		return errors.Errorf("opening ssh session recording file: %w", err)
+	}
+	recP := filepath.Join(rec.Dir, filepath.FromSlash(rel))
+	// marks the recording as live for `loghead recordings compress` until f is closed
+	if err := lockFile(f); err != nil && !errors.Is(err, errLockUnsupported) {
+		log.Warn().Err(err).Msgf("Locking recording %s", rel)
+	}
+	w, err := newRecordingWriter(f, rec.Compression, rec.Recipients)
 	if err != nil {
+		f.Close()
 		return errors.Errorf("opening ssh session recording file: %w", err)
 	}
+	r := newRecording(rel, meta)
+	if target != nil {
+		r.TargetNode = target.NodeName
+		r.TargetNodeID = target.NodeID
+		r.TargetNodeTags = target.Tags
+	}
+	rec.Index.Add(r)
+	if err := writeSidecar(recP, *r); err != nil {
+		log.Warn().Err(err).Msgf("Indexing recording %s", r.Path)
+	}
+	stopAcks := func() error { return nil }
+	if ack != nil {
+		stopAcks = sendAcks(w, s, interval, ack)
+	}
+	defer func() {
+		if aerr := stopAcks(); aerr != nil {
+			// the cause of the aborted recording
+			err = aerr
+		}
+		cerr := errors.Join(w.Close(), f.Sync(), f.Close())
+		if cerr != nil && err == nil {
+			err = errors.Errorf("closing ssh session recording file: %w", cerr)
+		}
+		// also index and sign recordings that were interrupted
+		w.events.endLine()
+		end := r.Start.Add(w.events.last)
+		if rec.Manifests != nil {
+			m := Manifest{
+				ID:        r.ID,
+				Path:      strings.TrimSuffix(r.Path, zstdExt),
+				Size:      w.Size(),
+				SHA256:    w.Sum(),
+				Start:     r.Start.UTC(),
+				End:       end.UTC(),
+				Completed: time.Now().UTC(),
+			}
+			if r.Encrypted {
+				m.Path = r.Path
+				m.Encrypted = true
+			}
+			merr := rec.Manifests.Append(m)
+			if merr != nil && err == nil {
+				err = errors.Errorf("signing ssh session recording: %w", merr)
+			}
+		}
+		rec.finish(recP, r, end)
+		if ack != nil && err == nil {
+			err = ack(w.Written())
+		}
+	}()
 	// write the metadata out
-	_, err = f.Write(b)
+	_, err = w.Write(b)
 	if err != nil {
 		return errors.Errorf("writing ssh session recording: %w", err)
 	}
 	// stream the rest of the logs directly to the file
-	_, err = io.Copy(f, s)
+	_, err = io.Copy(w, s)
 	if err != nil {
 		return errors.Errorf("writing ssh session recording: %w", err)
 	}
-	err = f.Close()
+	return nil
+}
+
+// kubernetesDir is the directory of Kubernetes sessions below the recordings directory
+const kubernetesDir = "kubernetes"
+
+// recordingName returns the path of a recording without extension, relative to the recordings directory.
+func (rec *RecordingService) recordingName(meta *CastMetadata, target *types.PeerIdentity) (string, error) {
+	if k := meta.Kubernetes; k != nil {
+		// <cluster>/<namespace>/<pod>, the names are DNS labels or subdomains
+		if isValidName(k.Namespace) && isValidName(k.PodName) {
+			return path.Join(kubernetesDir, rec.KubernetesCluster, k.Namespace, k.PodName, meta.Timestamp.Format(time.RFC3339)), nil
+		}
+		// the session is still recorded, it is named like SSH sessions
+		log.Warn().Msgf("Invalid kubernetes namespace %q or pod %q, naming the recording like SSH sessions", k.Namespace, k.PodName)
+	}
+	// by default recordings are stored by the accesing node's stable node id,
+	// tailscale instead uses the target's stable node id, which is known on tsnet listeners
+	// https://tailscale.com/kb/1246/tailscale-ssh-session-recording?q=.cast#session-recordings
+	return executeNaming(rec.Naming, newNameData(meta, target))
+}
+
+var validNameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// isValidName reports whether n is a Kubernetes object name, which can be used as a directory name.
+func isValidName(n string) bool {
+	return len(n) <= 253 && validNameRe.MatchString(n) && !strings.Contains(n, "..")
+}
+
+// sendAcks periodically syncs the recording and acknowledges the bytes on disk until stop is called.
+// stop returns the error that aborted the recording, if any.
+func sendAcks(w *recordingWriter, s io.Closer, interval time.Duration, ack func(int64) error) (stop func() error) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	var err error
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			var n int64
+			n, err = w.Sync()
+			if err == nil {
+				err = ack(n)
+			}
+			if err != nil {
+				// the client stops the session if it does not receive acks
+				s.Close()
+				return
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		<-stopped
+		return err
+	}
+}
+
+// Open returns the recording with the given id.
+func (rec *RecordingService) Open(id string) (io.ReadCloser, Recording, error) {
+	r, err := rec.Index.Get(id)
 	if err != nil {
-		return errors.Errorf("closing ssh session recording file: %w", err)
+		return nil, r, err
+	}
+	f, err := rec.openRecordingPath(r.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, r, ErrRecordingNotFound
+	}
+	if err != nil {
+		return nil, r, errors.Errorf("opening recording: %w", err)
+	}
+	return f, r, nil
+}
+
+// finish updates the index and the sidecar with the end time and size of the recording.
+func (rec *RecordingService) finish(p string, r *Recording, end time.Time) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Indexing recording %s", r.Path)
+		return
+	}
+	rec.Index.Finish(r.ID, end, fi.Size())
+	fr, err := rec.Index.Get(r.ID)
+	if err == nil {
+		err = writeSidecar(p, fr)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Indexing recording %s", r.Path)
 	}
-	return nil
 }
 
 func readSingleUntil(r io.Reader, sep []byte) ([]byte, error) {
@@ -136,3 +369,17 @@ func readCastMetadata(b []byte) (*CastMetadata, error) {
 	}
 	return &metadata, nil
 }
+
+// openRecordingPath opens the recording with the relative path for reading.
+// It finds recordings that were compressed since the path was recorded.
+func (rec *RecordingService) openRecordingPath(rel string) (io.ReadCloser, error) {
+	p, err := util.SafeJoin(rec.Dir, filepath.FromSlash(rel))
+	if err != nil {
+		return nil, err
+	}
+	f, err := openRecordingFile(p)
+	if errors.Is(err, os.ErrNotExist) && !strings.HasSuffix(p, zstdExt) {
+		f, err = openRecordingFile(p + zstdExt)
+	}
+	return f, err
+}
@@ -36,3 +36,26 @@ func TestReadSingleUntil(t *testing.T) {
 		})
 	}
 }
+
+func TestReadCastMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		tags []string
+	}{
+		{name: "untagged", in: `{"version":2,"srcNode":"laptop","srcNodeUser":"alice@example.com"}`},
+		// tailscaled sends the tags of tagged nodes as a list
+		{name: "tagged", in: `{"version":2,"srcNode":"ci","srcNodeTags":["tag:ci","tag:prod"]}`, tags: []string{"tag:ci", "tag:prod"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			meta, err := readCastMetadata([]byte(tc.in + "\n"))
+			if err != nil || !reflect.DeepEqual(meta.SrcNodeTags, tc.tags) {
+				t.Fatalf(`readCastMetadata(%s) = %+v, %s, want tags %v`, tc.in, meta, err, tc.tags)
+			}
+		})
+	}
+	if _, err := readCastMetadata([]byte(`{"version":2}`)); err == nil {
+		t.Fatal(`readCastMetadata() without newline succeeded`)
+	}
+}
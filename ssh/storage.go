@@ -0,0 +1,377 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"filippo.io/age"
+	"github.com/cockroachdb/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/qup42/loghead/util"
+	"github.com/rs/zerolog/log"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"tailscale.com/smallzstd"
+	"time"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+
+	// extension of compressed recordings, after .cast
+	zstdExt = ".zst"
+
+	// size of the plaintext chunks age encrypts
+	ageChunkSize = 64 << 10
+)
+
+// eventTracker follows a recording as it is written and remembers the time of the last event.
+type eventTracker struct {
+	// beginning of the current line
+	prefix     []byte
+	pastHeader bool
+	last       time.Duration
+}
+
+// events start with their time, e.g. [12.25,"o","data"]
+var eventTimeRe = regexp.MustCompile(`^\[\s*([0-9.eE+-]+)\s*,`)
+
+// prefix of a line that is kept to find the time
+const eventPrefixLen = 32
+
+func (t *eventTracker) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		line := p
+		if i >= 0 {
+			line = p[:i]
+		}
+		if room := eventPrefixLen - len(t.prefix); room > 0 {
+			t.prefix = append(t.prefix, line[:min(room, len(line))]...)
+		}
+		if i < 0 {
+			break
+		}
+		t.endLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// endLine takes the time of the current line. It is also called for the last line, which may not be terminated.
+func (t *eventTracker) endLine() {
+	// the first line is the header
+	if t.pastHeader {
+		if m := eventTimeRe.FindSubmatch(t.prefix); m != nil {
+			if s, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+				t.last = time.Duration(s * float64(time.Second))
+			}
+		}
+	}
+	t.pastHeader = true
+	t.prefix = t.prefix[:0]
+}
+
+// recordingWriter writes a recording to its file, compressing and encrypting it if enabled.
+// It keeps the size and hash of the recording for its manifest.
+// They cover the uncompressed recording, or the file if the recording is encrypted.
+type recordingWriter struct {
+	f *os.File
+	// the recording is written to dst, which passes it on to the file
+	dst    io.Writer
+	enc    *zstd.Encoder
+	age    io.WriteCloser
+	digest *hashWriter
+	events eventTracker
+
+	mu sync.Mutex
+	// bytes of the recording that were written
+	written int64
+	// bytes that were passed to the encryption, and the marks of where each write ended in them
+	ageIn *countWriter
+	marks []writeMark
+	// bytes of the recording that are on disk
+	durable int64
+}
+
+// writeMark maps the end of a write to the end of its data in the encrypted stream.
+type writeMark struct {
+	written int64
+	ageIn   int64
+}
+
+// hashWriter hashes and counts the bytes it passes on.
+type hashWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (h *hashWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	_, _ = h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// countWriter counts the bytes it passes on.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newRecordingWriter(f *os.File, compression string, recipients []age.Recipient) (*recordingWriter, error) {
+	w := &recordingWriter{f: f, digest: &hashWriter{w: f, hash: sha256.New()}}
+	w.dst = w.digest
+	if len(recipients) > 0 {
+		// the hash is taken from the encrypted file, the plain recording cannot be read again
+		aw, err := age.Encrypt(w.digest, recipients...)
+		if err != nil {
+			return nil, errors.Errorf("encrypting recording: %w", err)
+		}
+		w.age = aw
+		w.ageIn = &countWriter{w: aw}
+		w.dst = w.ageIn
+	}
+	if compression == CompressionZstd {
+		if w.age != nil {
+			enc, err := newZstdEncoder(w.ageIn)
+			if err != nil {
+				return nil, err
+			}
+			w.enc = enc
+			w.dst = enc
+		} else {
+			// hash the uncompressed recording
+			enc, err := newZstdEncoder(f)
+			if err != nil {
+				return nil, err
+			}
+			w.enc = enc
+			w.digest.w = enc
+		}
+	}
+	return w, nil
+}
+
+func newZstdEncoder(w io.Writer) (*zstd.Encoder, error) {
+	enc, err := smallzstd.NewEncoder(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	if err != nil {
+		return nil, errors.Errorf("creating zstd encoder: %w", err)
+	}
+	return enc, nil
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.dst.Write(p)
+	if err == nil && w.enc != nil {
+		// complete the block, so that everything received so far can be read
+		// even if the recording is interrupted
+		err = w.enc.Flush()
+	}
+	_, _ = w.events.Write(p[:n])
+	w.written += int64(n)
+	if w.ageIn != nil && err == nil {
+		w.marks = append(w.marks, writeMark{written: w.written, ageIn: w.ageIn.n})
+	}
+	return n, err
+}
+
+// Sync flushes the file to disk and returns the number of bytes of the recording that are durably written.
+func (w *recordingWriter) Sync() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.f.Sync(); err != nil {
+		return w.durable, errors.Errorf("syncing recording: %w", err)
+	}
+	if w.ageIn == nil {
+		w.durable = w.written
+		return w.durable, nil
+	}
+	// age only writes a chunk once the next chunk starts, the data of the last chunk is not on disk yet
+	rest := w.ageIn.n % ageChunkSize
+	if rest == 0 && w.ageIn.n > 0 {
+		rest = ageChunkSize
+	}
+	onDisk := w.ageIn.n - rest
+	i := 0
+	for ; i < len(w.marks) && w.marks[i].ageIn <= onDisk; i++ {
+		w.durable = w.marks[i].written
+	}
+	w.marks = w.marks[i:]
+	return w.durable, nil
+}
+
+// Written returns the number of bytes of the recording that were written.
+func (w *recordingWriter) Written() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
+
+// Sum returns the SHA-256 of the recording.
+func (w *recordingWriter) Sum() string {
+	return hex.EncodeToString(w.digest.hash.Sum(nil))
+}
+
+// Size returns the size of the recording.
+func (w *recordingWriter) Size() int64 {
+	return w.digest.size
+}
+
+// Close completes the compressed and encrypted streams. It does not close the file.
+func (w *recordingWriter) Close() error {
+	var err error
+	if w.enc != nil {
+		err = w.enc.Close()
+	}
+	if w.age != nil {
+		err = errors.Join(err, w.age.Close())
+	}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// openRecordingFile returns a reader for the uncompressed recording.
+// Encrypted recordings are returned as they are.
+func openRecordingFile(p string) (io.ReadCloser, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(p, zstdExt) {
+		return f, nil
+	}
+	zr, err := util.NewZstdReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Errorf("decompressing recording: %w", err)
+	}
+	return readCloser{zr, func() error {
+		return errors.Join(zr.Close(), f.Close())
+	}}, nil
+}
+
+// isRecording reports whether the file is a recording.
+func isRecording(p string) bool {
+	p = strings.TrimSuffix(p, ageExt)
+	return strings.HasSuffix(p, ".cast") || strings.HasSuffix(p, ".cast"+zstdExt)
+}
+
+var errLockUnsupported = errors.New("file locks are not supported on this platform")
+
+// lockRecording locks the recording at p, which fails while the recorder writes to it.
+// The returned function releases the lock.
+func lockRecording(p string) (func(), error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// CompressRecordings compresses the uncompressed recordings in dir that were not modified for minAge
+// and are not being recorded. It returns the number of compressed recordings.
+func CompressRecordings(dir string, minAge time.Duration) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".cast") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// skip recordings that may still be written to
+		if time.Since(fi.ModTime()) < minAge {
+			log.Info().Msgf("Skipping recent recording %s", p)
+			return nil
+		}
+		// the end is set when the session is closed. Idle sessions are not modified for a long time,
+		// but the recorder holds a lock on them, unlike on the recordings of sessions that loghead did not close.
+		if r, err := readSidecar(p, ""); err == nil && r.End.IsZero() {
+			release, err := lockRecording(p)
+			if err != nil {
+				log.Info().Msgf("Skipping unfinished recording %s: %s", p, err)
+				return nil
+			}
+			defer release()
+		}
+		if err := compressRecording(p, fi); err != nil {
+			return errors.Errorf("compressing %s: %w", p, err)
+		}
+		log.Info().Msgf("Compressed recording %s", p)
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func compressRecording(p string, fi fs.FileInfo) error {
+	dst := p + zstdExt
+	// a previous run was interrupted after the compressed recording was complete
+	if _, err := os.Stat(dst); err == nil {
+		return os.Remove(p)
+	}
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	enc, err := newZstdEncoder(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = io.Copy(enc, src)
+	err = errors.Join(err, enc.Close(), f.Sync(), f.Close())
+	if err != nil {
+		return err
+	}
+	// keep the modification time, it tells when the session ended
+	if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
@@ -0,0 +1,183 @@
+package ssh
+
+import (
+	"bytes"
+	"filippo.io/age"
+	"github.com/qup42/loghead/types"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const storageMeta = `{"version":2,"timestamp":1735689600,"srcNode":"laptop","srcNodeID":"n1","sshUser":"root","localUser":"root","connectionID":"c1"}`
+
+func readRecordingBody(t *testing.T, rs *RecordingService, id string) string {
+	t.Helper()
+	f, _, err := rs.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompressedRecording(t *testing.T) {
+	dir := t.TempDir()
+	rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: dir, Compression: CompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []string{`[0.5,"o","hello"]`, `[12.25,"o","` + strings.Repeat("x", 4096) + `"]`, ""}
+	record(t, rs, storageMeta, events...)
+	want := storageMeta + "\n" + strings.Join(events, "\n")
+
+	start := time.Unix(1735689600, 0)
+	r := rs.Index.List(RecordingFilter{})[0]
+	if r.Path != "n1/"+start.Format(time.RFC3339)+".cast.zst" || !r.End.Equal(start.Add(12250*time.Millisecond)) ||
+		r.Size == 0 || r.Size >= int64(len(want)) || r.Filename() != start.Format(time.RFC3339)+".cast" {
+		t.Fatalf(`recording = %+v`, r)
+	}
+	if got := readRecordingBody(t, rs, r.ID); got != want {
+		t.Fatalf(`Open(%s) = %q, want %q`, r.ID, got, want)
+	}
+
+	// rebuilt from disk
+	idx := NewIndex()
+	if err := idx.Rebuild(dir); err != nil {
+		t.Fatal(err)
+	}
+	if rr, err := idx.Get(r.ID); err != nil || !rr.End.Equal(r.End) || rr.Size != r.Size {
+		t.Fatalf(`Get(%s) = %+v, %s, want %+v`, r.ID, rr, err, r)
+	}
+}
+
+func TestCompressRecordings(t *testing.T) {
+	dir := t.TempDir()
+	rs, err := NewRecordingService(types.SSHRecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, rs, storageMeta, `[0.5,"o","hello"]`, `[3,"o","bye"]`, "")
+	r := rs.Index.List(RecordingFilter{})[0]
+	want := readRecordingBody(t, rs, r.ID)
+	p := filepath.Join(dir, filepath.FromSlash(r.Path))
+
+	// recent recordings are skipped
+	if n, err := CompressRecordings(dir, time.Hour); err != nil || n != 0 {
+		t.Fatalf(`CompressRecordings() = %d, %s, want 0`, n, err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CompressRecordings(dir, time.Hour); err != nil || n != 1 {
+		t.Fatalf(`CompressRecordings() = %d, %s, want 1`, n, err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf(`uncompressed recording was not removed: %s`, err)
+	}
+	fi, err := os.Stat(p + zstdExt)
+	if err != nil || !fi.ModTime().Equal(old) {
+		t.Fatalf(`compressed recording = %+v, %s`, fi, err)
+	}
+
+	// the running service still finds the recording
+	if got := readRecordingBody(t, rs, r.ID); got != want {
+		t.Fatalf(`Open(%s) = %q, want %q`, r.ID, got, want)
+	}
+	// the id is kept
+	idx := NewIndex()
+	if err := idx.Rebuild(dir); err != nil {
+		t.Fatal(err)
+	}
+	if rr, err := idx.Get(r.ID); err != nil || !rr.End.Equal(r.End) || !strings.HasSuffix(rr.Path, ".cast.zst") {
+		t.Fatalf(`Get(%s) = %+v, %s`, r.ID, rr, err)
+	}
+
+	// neither has an idle session that is still recorded, or a session that loghead did not close
+	idle := filepath.Join(dir, "idle.cast")
+	crashed := filepath.Join(dir, "crashed.cast")
+	for _, p := range []string{idle, crashed} {
+		if err := os.WriteFile(p, []byte(`{"version": 2}`+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeSidecar(p, Recording{Start: old}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the recorder holds a lock while it records
+	f, err := os.Open(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CompressRecordings(dir, time.Hour); err != nil || n != 1 {
+		t.Fatalf(`CompressRecordings() = %d, %s, want 1`, n, err)
+	}
+	if _, err := os.Stat(idle); err != nil {
+		t.Fatalf(`recorded session was compressed: %s`, err)
+	}
+	if _, err := os.Stat(crashed + ".zst"); err != nil {
+		t.Fatalf(`interrupted recording was not compressed: %s`, err)
+	}
+}
+
+func TestRecordingWriterSync(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		compression string
+		recipients  []age.Recipient
+		// durable bytes after a short write and after a write that completes a chunk of the encryption
+		want []int64
+	}{
+		{name: "plain", compression: CompressionNone, want: []int64{10, 10 + 70<<10}},
+		{name: "zstd", compression: CompressionZstd, want: []int64{10, 10 + 70<<10}},
+		// only complete chunks are on disk
+		{name: "age", compression: CompressionNone, recipients: []age.Recipient{id.Recipient()}, want: []int64{0, 10}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "rec"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			w, err := newRecordingWriter(f, tc.compression, tc.recipients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int64
+			for _, b := range [][]byte{make([]byte, 10), bytes.Repeat([]byte("x"), 70<<10)} {
+				if _, err := w.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				n, err := w.Sync()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, n)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf(`Sync() = %v, want %v`, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package ssh
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed web
+var web embed.FS
+
+// Web returns the files of the web page that lists and plays the recordings.
+func Web() fs.FS {
+	sub, err := fs.Sub(web, "web")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
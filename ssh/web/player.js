@@ -0,0 +1,564 @@
+"use strict";
+
+// A player for asciicast v2 recordings (https://docs.asciinema.org/manual/asciicast/v2/)
+// with a small terminal emulator that handles the common escape sequences.
+
+const palette = [
+  "#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+  "#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+];
+
+function color256(n) {
+  if (n < 16) return palette[n];
+  if (n < 232) {
+    n -= 16;
+    const v = (c) => (c === 0 ? 0 : 55 + c * 40);
+    return `rgb(${v(Math.floor(n / 36))},${v(Math.floor(n / 6) % 6)},${v(n % 6)})`;
+  }
+  const g = 8 + (n - 232) * 10;
+  return `rgb(${g},${g},${g})`;
+}
+
+class Terminal {
+  constructor(cols, rows) {
+    this.resize(cols, rows);
+  }
+
+  resize(cols, rows) {
+    this.cols = cols;
+    this.rows = rows;
+    this.reset();
+  }
+
+  reset() {
+    this.style = {};
+    this.x = 0;
+    this.y = 0;
+    this.saved = { x: 0, y: 0 };
+    this.top = 0;
+    this.bottom = this.rows - 1;
+    this.state = "normal";
+    this.params = "";
+    this.lines = [];
+    for (let i = 0; i < this.rows; i++) this.lines.push(this.blankLine());
+  }
+
+  blankLine() {
+    const line = [];
+    for (let i = 0; i < this.cols; i++) line.push({ ch: " ", style: this.style });
+    return line;
+  }
+
+  scrollUp(n = 1) {
+    for (let i = 0; i < n; i++) {
+      this.lines.splice(this.top, 1);
+      this.lines.splice(this.bottom, 0, this.blankLine());
+    }
+  }
+
+  scrollDown(n = 1) {
+    for (let i = 0; i < n; i++) {
+      this.lines.splice(this.bottom, 1);
+      this.lines.splice(this.top, 0, this.blankLine());
+    }
+  }
+
+  newline() {
+    if (this.y === this.bottom) this.scrollUp();
+    else if (this.y < this.rows - 1) this.y++;
+  }
+
+  put(ch) {
+    if (this.x >= this.cols) {
+      this.x = 0;
+      this.newline();
+    }
+    this.lines[this.y][this.x] = { ch, style: this.style };
+    this.x++;
+  }
+
+  erase(line, from, to) {
+    for (let i = Math.max(from, 0); i < Math.min(to, this.cols); i++) {
+      line[i] = { ch: " ", style: this.style };
+    }
+  }
+
+  write(data) {
+    for (const ch of data) {
+      switch (this.state) {
+        case "normal":
+          this.normal(ch);
+          break;
+        case "esc":
+          this.escape(ch);
+          break;
+        case "csi":
+          if (ch >= "@" && ch <= "~") {
+            this.state = "normal";
+            this.csi(ch, this.params);
+          } else {
+            this.params += ch;
+          }
+          break;
+        case "osc":
+          // operating system commands end with BEL or ST
+          if (ch === "\x07") this.state = "normal";
+          else if (ch === "\x1b") this.state = "esc";
+          break;
+        case "charset":
+          this.state = "normal";
+          break;
+      }
+    }
+  }
+
+  normal(ch) {
+    switch (ch) {
+      case "\x1b":
+        this.state = "esc";
+        break;
+      case "\r":
+        this.x = 0;
+        break;
+      case "\n":
+      case "\x0b":
+      case "\x0c":
+        this.newline();
+        break;
+      case "\b":
+        this.x = Math.max(this.x - 1, 0);
+        break;
+      case "\t":
+        this.x = Math.min((Math.floor(this.x / 8) + 1) * 8, this.cols - 1);
+        break;
+      case "\x07":
+        break;
+      default:
+        if (ch >= " ") this.put(ch);
+    }
+  }
+
+  escape(ch) {
+    this.state = "normal";
+    switch (ch) {
+      case "[":
+        this.state = "csi";
+        this.params = "";
+        break;
+      case "]":
+        this.state = "osc";
+        break;
+      case "(":
+      case ")":
+        this.state = "charset";
+        break;
+      case "7":
+        this.saved = { x: this.x, y: this.y };
+        break;
+      case "8":
+        this.x = this.saved.x;
+        this.y = this.saved.y;
+        break;
+      case "D":
+        this.newline();
+        break;
+      case "E":
+        this.x = 0;
+        this.newline();
+        break;
+      case "M":
+        if (this.y === this.top) this.scrollDown();
+        else this.y = Math.max(this.y - 1, 0);
+        break;
+      case "c":
+        this.reset();
+        break;
+    }
+  }
+
+  csi(cmd, params) {
+    const priv = params.startsWith("?");
+    const args = (priv ? params.slice(1) : params).split(";").map((p) => parseInt(p, 10));
+    const arg = (i, def = 1) => (isNaN(args[i]) || args[i] === 0 ? def : args[i]);
+    const clampX = (x) => Math.min(Math.max(x, 0), this.cols - 1);
+    const clampY = (y) => Math.min(Math.max(y, 0), this.rows - 1);
+    switch (cmd) {
+      case "A": this.y = clampY(this.y - arg(0)); break;
+      case "B": this.y = clampY(this.y + arg(0)); break;
+      case "C": this.x = clampX(this.x + arg(0)); break;
+      case "D": this.x = clampX(Math.min(this.x, this.cols - 1) - arg(0)); break;
+      case "E": this.x = 0; this.y = clampY(this.y + arg(0)); break;
+      case "F": this.x = 0; this.y = clampY(this.y - arg(0)); break;
+      case "G": case "`": this.x = clampX(arg(0) - 1); break;
+      case "d": this.y = clampY(arg(0) - 1); break;
+      case "H": case "f":
+        this.y = clampY(arg(0) - 1);
+        this.x = clampX(arg(1) - 1);
+        break;
+      case "J": {
+        const mode = isNaN(args[0]) ? 0 : args[0];
+        if (mode === 0) {
+          this.erase(this.lines[this.y], this.x, this.cols);
+          for (let y = this.y + 1; y < this.rows; y++) this.lines[y] = this.blankLine();
+        } else if (mode === 1) {
+          this.erase(this.lines[this.y], 0, this.x + 1);
+          for (let y = 0; y < this.y; y++) this.lines[y] = this.blankLine();
+        } else {
+          for (let y = 0; y < this.rows; y++) this.lines[y] = this.blankLine();
+        }
+        break;
+      }
+      case "K": {
+        const mode = isNaN(args[0]) ? 0 : args[0];
+        const line = this.lines[this.y];
+        if (mode === 0) this.erase(line, this.x, this.cols);
+        else if (mode === 1) this.erase(line, 0, this.x + 1);
+        else this.erase(line, 0, this.cols);
+        break;
+      }
+      case "X": this.erase(this.lines[this.y], this.x, this.x + arg(0)); break;
+      case "P": {
+        const line = this.lines[this.y];
+        line.splice(this.x, arg(0));
+        while (line.length < this.cols) line.push({ ch: " ", style: this.style });
+        break;
+      }
+      case "@": {
+        const line = this.lines[this.y];
+        for (let i = 0; i < arg(0); i++) line.splice(this.x, 0, { ch: " ", style: this.style });
+        line.length = this.cols;
+        break;
+      }
+      case "L":
+        if (this.y >= this.top && this.y <= this.bottom) {
+          for (let i = 0; i < arg(0); i++) {
+            this.lines.splice(this.bottom, 1);
+            this.lines.splice(this.y, 0, this.blankLine());
+          }
+        }
+        break;
+      case "M":
+        if (this.y >= this.top && this.y <= this.bottom) {
+          for (let i = 0; i < arg(0); i++) {
+            this.lines.splice(this.y, 1);
+            this.lines.splice(this.bottom, 0, this.blankLine());
+          }
+        }
+        break;
+      case "S": this.scrollUp(arg(0)); break;
+      case "T": this.scrollDown(arg(0)); break;
+      case "r":
+        this.top = clampY(arg(0) - 1);
+        this.bottom = clampY(arg(1, this.rows) - 1);
+        this.x = 0;
+        this.y = 0;
+        break;
+      case "s": this.saved = { x: this.x, y: this.y }; break;
+      case "u": this.x = this.saved.x; this.y = this.saved.y; break;
+      case "h": case "l":
+        // switching to and from the alternate screen clears it
+        if (priv && [47, 1047, 1049].includes(args[0])) {
+          for (let y = 0; y < this.rows; y++) this.lines[y] = this.blankLine();
+        }
+        break;
+      case "m": this.sgr(params === "" ? [0] : args); break;
+    }
+  }
+
+  sgr(args) {
+    const s = { ...this.style };
+    for (let i = 0; i < args.length; i++) {
+      const a = isNaN(args[i]) ? 0 : args[i];
+      if (a === 0) {
+        for (const k of Object.keys(s)) delete s[k];
+      } else if (a === 1) s.bold = true;
+      else if (a === 4) s.underline = true;
+      else if (a === 7) s.inverse = true;
+      else if (a === 22) delete s.bold;
+      else if (a === 24) delete s.underline;
+      else if (a === 27) delete s.inverse;
+      else if (a >= 30 && a <= 37) s.fg = palette[a - 30];
+      else if (a >= 90 && a <= 97) s.fg = palette[a - 90 + 8];
+      else if (a >= 40 && a <= 47) s.bg = palette[a - 40];
+      else if (a >= 100 && a <= 107) s.bg = palette[a - 100 + 8];
+      else if (a === 39) delete s.fg;
+      else if (a === 49) delete s.bg;
+      else if (a === 38 || a === 48) {
+        const key = a === 38 ? "fg" : "bg";
+        if (args[i + 1] === 5) {
+          s[key] = color256(args[i + 2]);
+          i += 2;
+        } else if (args[i + 1] === 2) {
+          s[key] = `rgb(${args[i + 2]},${args[i + 3]},${args[i + 4]})`;
+          i += 4;
+        }
+      }
+    }
+    this.style = s;
+  }
+
+  render(el) {
+    const escape = (t) => t.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+    const html = [];
+    for (let y = 0; y < this.rows; y++) {
+      let run = "";
+      let style = null;
+      const flush = () => {
+        if (run === "") return;
+        html.push(this.span(style, escape(run)));
+        run = "";
+      };
+      for (let x = 0; x < this.cols; x++) {
+        const cell = this.lines[y][x];
+        const isCursor = x === this.x && y === this.y;
+        if (cell.style !== style || isCursor) {
+          flush();
+          style = cell.style;
+        }
+        if (isCursor) {
+          html.push(this.span({ ...style, inverse: !style.inverse }, escape(cell.ch)));
+          style = null;
+        } else {
+          run += cell.ch;
+        }
+      }
+      flush();
+      html.push("\n");
+    }
+    el.innerHTML = html.join("");
+  }
+
+  span(style, text) {
+    let fg = style.fg;
+    let bg = style.bg;
+    if (style.inverse) {
+      fg = style.bg || "#121314";
+      bg = style.fg || "#cccccc";
+    }
+    const css = [];
+    if (fg) css.push(`color:${fg}`);
+    if (bg) css.push(`background:${bg}`);
+    const cls = [];
+    if (style.bold) cls.push("b");
+    if (style.underline) cls.push("u");
+    if (css.length === 0 && cls.length === 0) return text;
+    return `<span class="${cls.join(" ")}" style="${css.join(";")}">${text}</span>`;
+  }
+}
+
+class Player {
+  constructor(el, header, events) {
+    this.el = el;
+    this.header = header;
+    this.events = events;
+    this.duration = events.length > 0 ? events[events.length - 1][0] : 0;
+    this.term = new Terminal(header.width || 80, header.height || 24);
+    this.speed = 1;
+    this.playing = false;
+    this.seek(0);
+  }
+
+  // seek replays the recording up to t, terminals cannot be rewound
+  seek(t) {
+    this.term.reset();
+    this.next = 0;
+    this.time = Math.min(Math.max(t, 0), this.duration);
+    this.feed();
+    this.rebase();
+  }
+
+  feed() {
+    while (this.next < this.events.length && this.events[this.next][0] <= this.time) {
+      const [, code, data] = this.events[this.next];
+      if (code === "o") {
+        this.term.write(data);
+      } else if (code === "r") {
+        const [cols, rows] = data.split("x").map((n) => parseInt(n, 10));
+        if (cols > 0 && rows > 0) this.term.resize(cols, rows);
+      }
+      this.next++;
+    }
+    this.term.render(this.el);
+  }
+
+  rebase() {
+    this.wallStart = performance.now();
+    this.timeStart = this.time;
+  }
+
+  setSpeed(speed) {
+    this.speed = speed;
+    this.rebase();
+  }
+
+  play() {
+    if (this.time >= this.duration) this.seek(0);
+    this.playing = true;
+    this.rebase();
+    const tick = () => {
+      if (!this.playing) return;
+      this.time = Math.min(this.timeStart + ((performance.now() - this.wallStart) / 1000) * this.speed, this.duration);
+      this.feed();
+      if (this.onupdate) this.onupdate();
+      if (this.time >= this.duration) {
+        this.playing = false;
+        if (this.onupdate) this.onupdate();
+        return;
+      }
+      requestAnimationFrame(tick);
+    };
+    requestAnimationFrame(tick);
+  }
+
+  pause() {
+    this.playing = false;
+  }
+}
+
+function parseCast(text) {
+  const lines = text.split("\n").filter((l) => l.trim() !== "");
+  const header = JSON.parse(lines[0]);
+  const events = [];
+  for (const line of lines.slice(1)) {
+    try {
+      events.push(JSON.parse(line));
+    } catch (e) {
+      // the last line of an interrupted recording may be incomplete
+    }
+  }
+  return { header, events };
+}
+
+function formatDuration(s) {
+  s = Math.floor(s);
+  const h = Math.floor(s / 3600);
+  const m = Math.floor((s % 3600) / 60);
+  const sec = String(s % 60).padStart(2, "0");
+  return h > 0 ? `${h}:${String(m).padStart(2, "0")}:${sec}` : `${m}:${sec}`;
+}
+
+function formatSize(n) {
+  const units = ["B", "KB", "MB", "GB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return `${n.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+// target returns where the session was opened
+function target(rec) {
+  if (rec.kind === "kubernetes") {
+    return `${rec.cluster}/${rec.namespace}/${rec.pod}/${rec.container}`;
+  }
+  if (rec.targetNode) {
+    return `${rec.localUser}@${rec.targetNode}`;
+  }
+  return `${rec.sshUser}@${rec.localUser}`;
+}
+
+let player = null;
+
+async function open(rec) {
+  if (player) player.pause();
+  const url = `../${rec.id}/cast`;
+  const res = await fetch(url);
+  if (!res.ok) {
+    alert(`Loading the recording failed: ${await res.text()}`);
+    return;
+  }
+  const { header, events } = parseCast(await res.text());
+  document.getElementById("player").hidden = false;
+  document.getElementById("title").textContent =
+    `${target(rec)} from ${rec.srcNode}, ${new Date(rec.start).toLocaleString()}`;
+  document.getElementById("download").href = url;
+
+  const seek = document.getElementById("seek");
+  const time = document.getElementById("time");
+  const play = document.getElementById("play");
+  player = new Player(document.getElementById("terminal"), header, events);
+  player.setSpeed(parseFloat(document.getElementById("speed").value));
+  seek.max = player.duration;
+  const update = () => {
+    seek.value = player.time;
+    time.textContent = `${formatDuration(player.time)} / ${formatDuration(player.duration)}`;
+    play.textContent = player.playing ? "Pause" : "Play";
+  };
+  player.onupdate = update;
+  update();
+  document.getElementById("player").scrollIntoView();
+}
+
+async function search(form) {
+  const params = new URLSearchParams();
+  for (const [k, v] of new FormData(form)) {
+    if (v === "") continue;
+    params.set(k, k === "from" || k === "to" ? new Date(v).toISOString() : v);
+  }
+  const res = await fetch(`../?${params}`);
+  if (!res.ok) {
+    alert(`Searching failed: ${await res.text()}`);
+    return;
+  }
+  const tbody = document.querySelector("#recordings tbody");
+  tbody.replaceChildren();
+  for (const rec of await res.json()) {
+    const tr = document.createElement("tr");
+    const start = new Date(rec.start);
+    const ended = !rec.end.startsWith("0001-");
+    const cells = [
+      start.toLocaleString(),
+      ended ? formatDuration((new Date(rec.end) - start) / 1000) : "recording",
+      rec.srcNode,
+      rec.targetNode || "",
+      rec.srcNodeUser || "",
+      rec.sshUser,
+      rec.kind === "kubernetes" ? target(rec) : rec.localUser,
+      rec.command || "",
+      formatSize(rec.size),
+    ];
+    cells.forEach((text, i) => {
+      const td = document.createElement("td");
+      td.textContent = text;
+      if (i === 7) td.className = "command";
+      tr.appendChild(td);
+    });
+    const td = document.createElement("td");
+    if (rec.encrypted) {
+      // encrypted recordings can only be played after decrypting them
+      const a = document.createElement("a");
+      a.href = `../${rec.id}/cast`;
+      a.textContent = "Download (encrypted)";
+      td.appendChild(a);
+    } else {
+      const btn = document.createElement("button");
+      btn.type = "button";
+      btn.textContent = "Play";
+      btn.onclick = () => open(rec);
+      td.appendChild(btn);
+    }
+    tr.appendChild(td);
+    tbody.appendChild(tr);
+  }
+}
+
+document.getElementById("filter").addEventListener("submit", (e) => {
+  e.preventDefault();
+  search(e.target);
+});
+document.getElementById("play").addEventListener("click", () => {
+  if (!player) return;
+  if (player.playing) player.pause();
+  else player.play();
+  player.onupdate();
+});
+document.getElementById("seek").addEventListener("input", (e) => {
+  if (!player) return;
+  player.seek(parseFloat(e.target.value));
+  player.onupdate();
+});
+document.getElementById("speed").addEventListener("change", (e) => {
+  if (player) player.setSpeed(parseFloat(e.target.value));
+});
+search(document.getElementById("filter"));
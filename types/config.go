@@ -6,6 +6,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -13,16 +14,80 @@ type Config struct {
 	SSHRecorder SSHRecorderConfig
 	Loghead     LogheadConfig
 	NodeMetrics NodeMetricsConfig
+	Policy      PolicyConfig
 }
 
 type FileLoggerConfig struct {
+	Enabled       bool
+	Dir           string
+	Redact        string
+	Layout        string
+	Format        string
+	MaxOpenFiles  int
+	IdleTimeout   time.Duration
+	Fsync         string
+	FsyncInterval time.Duration
+}
+
+type ExternalProcessorConfig struct {
 	Enabled bool
-	Dir     string
+	Command []string
+	Replace bool
+	// in bytes
+	Buffer     int64
+	Timeout    time.Duration
+	MaxBackoff time.Duration
 }
 
 type ForwardingConfig struct {
 	Enabled bool
 	Addr    string
+	Redact  string
+}
+
+type FilterRuleConfig struct {
+	Name       string  `mapstructure:"name"`
+	Action     string  `mapstructure:"action"`
+	Collection string  `mapstructure:"collection"`
+	Node       string  `mapstructure:"node"`
+	Field      string  `mapstructure:"field"`
+	Match      string  `mapstructure:"match"`
+	Rate       float64 `mapstructure:"rate"`
+	Key        string  `mapstructure:"key"`
+	Limit      float64 `mapstructure:"limit"`
+}
+
+type TransformConfig struct {
+	Enabled   bool
+	ParseText bool
+	Inventory bool
+	Rename    []FieldRenameConfig
+	Remove    []string
+	Fields    []StaticFieldConfig
+}
+
+type FieldRenameConfig struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+type StaticFieldConfig struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+type ScriptConfig struct {
+	Enabled bool
+	File    string
+	// per invocation, 0 disables the limit
+	Timeout time.Duration
+}
+
+type RedactionProfileConfig struct {
+	Detectors []string
+	Patterns  []string
+	Action    string
+	Key       string
 }
 
 type LogConfig struct {
@@ -34,7 +99,10 @@ type ProcessorConfig struct {
 	FileLogger FileLoggerConfig
 	Metrics    bool
 	Hostinfo   bool
+	Sequence   bool
+	Annotate   bool
 	Forward    ForwardingConfig
+	External   ExternalProcessorConfig
 }
 
 type ListenerConfig struct {
@@ -45,20 +113,58 @@ type ListenerConfig struct {
 }
 
 type TSConfig struct {
-	AuthKey     string
-	ControllURL string
-	HostName    string
-	Dir         string
+	AuthKey          string
+	ControllURL      string
+	HostName         string
+	Dir              string
+	RequireKnownPeer bool
 }
 
 type SSHRecorderConfig struct {
-	Dir      string
-	Listener ListenerConfig
+	Dir         string
+	Listener    ListenerConfig
+	API         bool
+	Compression string
+	// path of the ed25519 key the recordings are signed with, signing is disabled if empty
+	SigningKey string
+	// age recipients the recordings are encrypted to, encryption is disabled if empty
+	Recipients []string
+	// name of the cluster Kubernetes sessions are stored under
+	KubernetesCluster string
+	// text/template for the path of SSH session recordings, without extension
+	Naming string
 }
 
 type LogheadConfig struct {
-	Processors ProcessorConfig
-	Listener   ListenerConfig
+	Processors  ProcessorConfig
+	Listener    ListenerConfig
+	Limits      LimitsConfig
+	DeadLetter  DeadLetterConfig
+	Collections []string
+	Redaction   map[string]RedactionProfileConfig
+	Redact      string
+	Filters     []FilterRuleConfig
+	Transform   TransformConfig
+	Script      ScriptConfig
+}
+
+type DeadLetterConfig struct {
+	Enabled bool
+	Dir     string
+	API     bool
+}
+
+type LimitsConfig struct {
+	// uploads per second, 0 disables the limit
+	PerNodeRate  float64
+	PerNodeBurst int
+	GlobalRate   float64
+	GlobalBurst  int
+	// requests processed concurrently, 0 disables the limit
+	MaxInFlight int
+	// in bytes, 0 disables the limit
+	MaxBodySize    int64
+	MaxDecodedSize int64
 }
 
 type NodeMetricsConfig struct {
@@ -67,6 +173,21 @@ type NodeMetricsConfig struct {
 	Listener ListenerConfig
 }
 
+type PolicyRuleConfig struct {
+	Enabled bool
+	Tags    []string
+	Users   []string
+	CIDRs   []string
+}
+
+type PolicyConfig struct {
+	ClientLogs    PolicyRuleConfig
+	SSHRecordings PolicyRuleConfig
+	NodeMetrics   PolicyRuleConfig
+	DeadLetter    PolicyRuleConfig
+	Recordings    PolicyRuleConfig
+}
+
 const (
 	JSONLogFormat = "json"
 	TextLogFormat = "text"
@@ -77,7 +198,21 @@ func GetProcessorConfig() ProcessorConfig {
 		FileLogger: GetFileLoggerConfig(),
 		Metrics:    viper.GetBool("loghead.processors.metrics"),
 		Hostinfo:   viper.GetBool("loghead.processors.hostinfo"),
+		Sequence:   viper.GetBool("loghead.processors.sequence"),
+		Annotate:   viper.GetBool("loghead.processors.annotate"),
 		Forward:    GetForwardingConfig(),
+		External:   GetExternalProcessorConfig(),
+	}
+}
+
+func GetExternalProcessorConfig() ExternalProcessorConfig {
+	return ExternalProcessorConfig{
+		Enabled:    viper.GetBool("loghead.processors.external.enabled"),
+		Command:    viper.GetStringSlice("loghead.processors.external.command"),
+		Replace:    viper.GetBool("loghead.processors.external.replace"),
+		Buffer:     int64(viper.GetSizeInBytes("loghead.processors.external.buffer")),
+		Timeout:    viper.GetDuration("loghead.processors.external.timeout"),
+		MaxBackoff: viper.GetDuration("loghead.processors.external.max_backoff"),
 	}
 }
 
@@ -85,6 +220,7 @@ func GetForwardingConfig() ForwardingConfig {
 	return ForwardingConfig{
 		Enabled: viper.GetBool("loghead.processors.forward.enabled"),
 		Addr:    viper.GetString("loghead.processors.forward.addr"),
+		Redact:  viper.GetString("loghead.processors.forward.redact"),
 	}
 }
 
@@ -99,24 +235,116 @@ func GetListenerConfig(base string) ListenerConfig {
 
 func GetTSConfig(base string) TSConfig {
 	return TSConfig{
-		AuthKey:     viper.GetString(base + ".tsnet.authKey"),
-		ControllURL: viper.GetString(base + ".tsnet.controllURL"),
-		HostName:    viper.GetString(base + ".tsnet.hostname"),
-		Dir:         viper.GetString(base + ".tsnet.dir"),
+		AuthKey:          viper.GetString(base + ".tsnet.authKey"),
+		ControllURL:      viper.GetString(base + ".tsnet.controllURL"),
+		HostName:         viper.GetString(base + ".tsnet.hostname"),
+		Dir:              viper.GetString(base + ".tsnet.dir"),
+		RequireKnownPeer: viper.GetBool(base + ".tsnet.requireKnownPeer"),
 	}
 }
 
 func GetSSHRecorderConfig() SSHRecorderConfig {
 	return SSHRecorderConfig{
-		Dir:      viper.GetString("ssh_recorder.dir"),
-		Listener: GetListenerConfig("ssh_recorder"),
+		Dir:               viper.GetString("ssh_recorder.dir"),
+		Listener:          GetListenerConfig("ssh_recorder"),
+		API:               viper.GetBool("ssh_recorder.api"),
+		Compression:       viper.GetString("ssh_recorder.compression"),
+		SigningKey:        viper.GetString("ssh_recorder.signing_key"),
+		Recipients:        viper.GetStringSlice("ssh_recorder.recipients"),
+		KubernetesCluster: viper.GetString("ssh_recorder.kubernetes_cluster"),
+		Naming:            viper.GetString("ssh_recorder.naming"),
 	}
 }
 
-func GetLogheadConfig() LogheadConfig {
+func GetLogheadConfig() (LogheadConfig, error) {
+	filters, err := GetFiltersConfig()
+	if err != nil {
+		return LogheadConfig{}, err
+	}
+	transform, err := GetTransformConfig()
+	if err != nil {
+		return LogheadConfig{}, err
+	}
 	return LogheadConfig{
-		Listener:   GetListenerConfig("loghead"),
-		Processors: GetProcessorConfig(),
+		Listener:    GetListenerConfig("loghead"),
+		Processors:  GetProcessorConfig(),
+		Limits:      GetLimitsConfig(),
+		DeadLetter:  GetDeadLetterConfig(),
+		Collections: viper.GetStringSlice("loghead.collections"),
+		Redaction:   GetRedactionConfig(),
+		Redact:      viper.GetString("loghead.redact"),
+		Filters:     filters,
+		Transform:   transform,
+		Script:      GetScriptConfig(),
+	}, nil
+}
+
+func GetScriptConfig() ScriptConfig {
+	return ScriptConfig{
+		Enabled: viper.GetBool("loghead.script.enabled"),
+		File:    viper.GetString("loghead.script.file"),
+		Timeout: viper.GetDuration("loghead.script.timeout"),
+	}
+}
+
+func GetTransformConfig() (TransformConfig, error) {
+	c := TransformConfig{
+		Enabled:   viper.GetBool("loghead.transform.enabled"),
+		ParseText: viper.GetBool("loghead.transform.parse_text"),
+		Inventory: viper.GetBool("loghead.transform.inventory"),
+		Remove:    viper.GetStringSlice("loghead.transform.remove"),
+	}
+	// lists of objects because viper lower cases map keys
+	if err := viper.UnmarshalKey("loghead.transform.rename", &c.Rename); err != nil {
+		return c, errors.Errorf("parsing loghead.transform.rename: %w", err)
+	}
+	if err := viper.UnmarshalKey("loghead.transform.fields", &c.Fields); err != nil {
+		return c, errors.Errorf("parsing loghead.transform.fields: %w", err)
+	}
+	return c, nil
+}
+
+// GetFiltersConfig fails if the filters cannot be parsed, since ignoring them could keep sensitive entries.
+func GetFiltersConfig() ([]FilterRuleConfig, error) {
+	var filters []FilterRuleConfig
+	if err := viper.UnmarshalKey("loghead.filters", &filters); err != nil {
+		return nil, errors.Errorf("parsing loghead.filters: %w", err)
+	}
+	return filters, nil
+}
+
+func GetRedactionConfig() map[string]RedactionProfileConfig {
+	profiles := map[string]RedactionProfileConfig{}
+	for name := range viper.GetStringMap("loghead.redaction") {
+		base := "loghead.redaction." + name
+		profiles[name] = RedactionProfileConfig{
+			Detectors: viper.GetStringSlice(base + ".detectors"),
+			Patterns:  viper.GetStringSlice(base + ".patterns"),
+			Action:    viper.GetString(base + ".action"),
+			Key:       viper.GetString(base + ".key"),
+		}
+	}
+	return profiles
+}
+
+func GetDeadLetterConfig() DeadLetterConfig {
+	return DeadLetterConfig{
+		Enabled: viper.GetBool("loghead.deadletter.enabled"),
+		Dir:     viper.GetString("loghead.deadletter.dir"),
+		API:     viper.GetBool("loghead.deadletter.api"),
+	}
+}
+
+func GetLimitsConfig() LimitsConfig {
+	return LimitsConfig{
+		PerNodeRate:  viper.GetFloat64("loghead.limits.rate.per_node"),
+		PerNodeBurst: viper.GetInt("loghead.limits.rate.per_node_burst"),
+		GlobalRate:   viper.GetFloat64("loghead.limits.rate.global"),
+		GlobalBurst:  viper.GetInt("loghead.limits.rate.global_burst"),
+		MaxInFlight:  viper.GetInt("loghead.limits.max_in_flight"),
+		// GetSizeInBytes accepts sizes like "16MB"
+		MaxBodySize:    int64(viper.GetSizeInBytes("loghead.limits.max_body_size")),
+		MaxDecodedSize: int64(viper.GetSizeInBytes("loghead.limits.max_decoded_size")),
 	}
 }
 
@@ -130,8 +358,34 @@ func GetNodeMetricsConfig() NodeMetricsConfig {
 
 func GetFileLoggerConfig() FileLoggerConfig {
 	return FileLoggerConfig{
-		Dir:     viper.GetString("loghead.processors.filelogger.dir"),
-		Enabled: viper.GetBool("loghead.processors.filelogger.enabled"),
+		Dir:           viper.GetString("loghead.processors.filelogger.dir"),
+		Enabled:       viper.GetBool("loghead.processors.filelogger.enabled"),
+		Redact:        viper.GetString("loghead.processors.filelogger.redact"),
+		Layout:        viper.GetString("loghead.processors.filelogger.layout"),
+		Format:        viper.GetString("loghead.processors.filelogger.format"),
+		MaxOpenFiles:  viper.GetInt("loghead.processors.filelogger.max_open_files"),
+		IdleTimeout:   viper.GetDuration("loghead.processors.filelogger.idle_timeout"),
+		Fsync:         viper.GetString("loghead.processors.filelogger.fsync"),
+		FsyncInterval: viper.GetDuration("loghead.processors.filelogger.fsync_interval"),
+	}
+}
+
+func GetPolicyRuleConfig(base string) PolicyRuleConfig {
+	return PolicyRuleConfig{
+		Enabled: viper.IsSet(base),
+		Tags:    viper.GetStringSlice(base + ".tags"),
+		Users:   viper.GetStringSlice(base + ".users"),
+		CIDRs:   viper.GetStringSlice(base + ".cidrs"),
+	}
+}
+
+func GetPolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		ClientLogs:    GetPolicyRuleConfig("policy.client_logs"),
+		SSHRecordings: GetPolicyRuleConfig("policy.ssh_recordings"),
+		NodeMetrics:   GetPolicyRuleConfig("policy.node_metrics"),
+		DeadLetter:    GetPolicyRuleConfig("policy.deadletter"),
+		Recordings:    GetPolicyRuleConfig("policy.recordings"),
 	}
 }
 
@@ -177,10 +431,42 @@ func LoadConfig() (*Config, error) {
 
 	viper.SetDefault("loghead.processors.filelogger.enabled", true)
 	viper.SetDefault("loghead.processors.filelogger.dir", "./logs")
+	viper.SetDefault("loghead.processors.filelogger.layout", "{collection}/{node}")
+	viper.SetDefault("loghead.processors.filelogger.format", "json")
+	viper.SetDefault("loghead.processors.filelogger.max_open_files", 256)
+	viper.SetDefault("loghead.processors.filelogger.idle_timeout", "1m")
+	viper.SetDefault("loghead.processors.filelogger.fsync", "never")
+	viper.SetDefault("loghead.processors.filelogger.fsync_interval", "1s")
 	viper.SetDefault("loghead.processors.forward.enabled", false)
 	viper.SetDefault("loghead.processors.forward.dir", "https://log.tailscale.io")
+	viper.SetDefault("loghead.processors.external.enabled", false)
+	viper.SetDefault("loghead.processors.external.replace", false)
+	viper.SetDefault("loghead.processors.external.buffer", "16MB")
+	viper.SetDefault("loghead.processors.external.timeout", "5s")
+	viper.SetDefault("loghead.processors.external.max_backoff", "30s")
 	viper.SetDefault("loghead.processors.metrics", false)
 	viper.SetDefault("loghead.processors.hostinfo", false)
+	viper.SetDefault("loghead.processors.sequence", false)
+	viper.SetDefault("loghead.processors.annotate", false)
+	viper.SetDefault("loghead.limits.rate.per_node", 0)
+	viper.SetDefault("loghead.limits.rate.per_node_burst", 10)
+	viper.SetDefault("loghead.limits.rate.global", 0)
+	viper.SetDefault("loghead.limits.rate.global_burst", 100)
+	viper.SetDefault("loghead.limits.max_in_flight", 0)
+	viper.SetDefault("loghead.limits.max_body_size", "16MB")
+	viper.SetDefault("loghead.limits.max_decoded_size", "64MB")
+	// same as logs.TailnodeCollection and logs.TailtrafficCollection
+	viper.SetDefault("loghead.collections", []string{"tailnode.log.tailscale.io", "tailtraffic.log.tailscale.io"})
+	viper.SetDefault("loghead.deadletter.enabled", false)
+	viper.SetDefault("loghead.deadletter.dir", "./deadletter")
+	viper.SetDefault("loghead.deadletter.api", false)
+	viper.SetDefault("loghead.redact", "")
+	viper.SetDefault("loghead.transform.enabled", false)
+	viper.SetDefault("loghead.transform.parse_text", true)
+	viper.SetDefault("loghead.transform.inventory", false)
+	viper.SetDefault("loghead.script.enabled", false)
+	viper.SetDefault("loghead.script.file", "./process.star")
+	viper.SetDefault("loghead.script.timeout", "10ms")
 	viper.SetDefault("loghead.listener.type", "plain")
 	viper.SetDefault("loghead.listener.addr", "0.0.0.0")
 	viper.SetDefault("loghead.listener.port", "5678")
@@ -188,6 +474,12 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("loghead.listener.tsnet.dir", "/tsnet-state/loghead")
 
 	viper.SetDefault("ssh_recorder.dir", "./recordings")
+	viper.SetDefault("ssh_recorder.api", false)
+	viper.SetDefault("ssh_recorder.compression", "none")
+	viper.SetDefault("ssh_recorder.signing_key", "")
+	viper.SetDefault("ssh_recorder.recipients", []string{})
+	viper.SetDefault("ssh_recorder.kubernetes_cluster", "default")
+	viper.SetDefault("ssh_recorder.naming", "{{.SrcNodeID}}/{{.Timestamp}}")
 	viper.SetDefault("ssh_recorder.listener.type", "tsnet")
 	viper.SetDefault("ssh_recorder.listener.addr", "0.0.0.0")
 	viper.SetDefault("ssh_recorder.listener.port", "80")
@@ -218,10 +510,16 @@ func LoadConfig() (*Config, error) {
 		return nil, errors.New(strings.TrimSuffix(errorText, "\n"))
 	}
 
+	loghead, err := GetLogheadConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
 		Log:         GetLogConfig(),
 		SSHRecorder: GetSSHRecorderConfig(),
-		Loghead:     GetLogheadConfig(),
+		Loghead:     loghead,
 		NodeMetrics: GetNodeMetricsConfig(),
+		Policy:      GetPolicyConfig(),
 	}, nil
 }
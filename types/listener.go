@@ -6,13 +6,23 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/rs/zerolog/log"
 	"net"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tsnet"
 	"time"
 )
 
+// WhoIsClient resolves the tailnet identity of a peer, it is implemented by *local.Client.
+type WhoIsClient interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+var _ WhoIsClient = (*local.Client)(nil)
+
 type Listener struct {
-	Listener net.Listener
-	TSServer *tsnet.Server
+	Listener    net.Listener
+	TSServer    *tsnet.Server
+	LocalClient WhoIsClient
 }
 
 func waitTSReady(ctx context.Context, s *tsnet.Server) error {
@@ -56,7 +66,7 @@ func MakeListener(ctx context.Context, c ListenerConfig, componentName string) (
 			return nil, errors.Errorf("binding port: %w", err)
 		}
 		log.Info().Msgf("%s Listening on %s:%s", componentName, c.Addr, c.Port)
-		return &Listener{ln, nil}, nil
+		return &Listener{ln, nil, nil}, nil
 	case "tsnet":
 		s, err := makeTS(ctx, c)
 		if err != nil {
@@ -67,13 +77,30 @@ func MakeListener(ctx context.Context, c ListenerConfig, componentName string) (
 		if err != nil {
 			return nil, errors.Errorf("binding port on ts listener: %w", err)
 		}
+		lc, err := s.LocalClient()
+		if err != nil {
+			return nil, errors.Errorf("getting ts local client: %w", err)
+		}
 		log.Info().Msgf("%s Listening over tailscale on :%s", componentName, c.Port)
-		return &Listener{ln, s}, nil
+		return &Listener{ln, s, lc}, nil
 	default:
 		return nil, errors.Errorf("unknown listener type %s", c.Type)
 	}
 }
 
+// WhoIs resolves the tailnet identity of the peer at remoteAddr.
+// It returns nil if the listener is not a tsnet listener.
+func (ln *Listener) WhoIs(ctx context.Context, remoteAddr string) (*PeerIdentity, error) {
+	if ln.LocalClient == nil {
+		return nil, nil
+	}
+	w, err := ln.LocalClient.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		return nil, errors.Errorf("whois %s: %w", remoteAddr, err)
+	}
+	return newPeerIdentity(w), nil
+}
+
 func (ln *Listener) Close() error {
 	errListener := ln.Listener.Close()
 	var errTSServer error
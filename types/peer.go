@@ -0,0 +1,41 @@
+package types
+
+import (
+	"context"
+	"strings"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// PeerIdentity is the tailnet identity of the node on the other end of a connection.
+type PeerIdentity struct {
+	NodeName string
+	NodeID   string
+	Tags     []string
+	User     string
+}
+
+func newPeerIdentity(w *apitype.WhoIsResponse) *PeerIdentity {
+	p := &PeerIdentity{}
+	if w.Node != nil {
+		p.NodeName = strings.TrimSuffix(w.Node.Name, ".")
+		p.NodeID = string(w.Node.StableID)
+		p.Tags = w.Node.Tags
+	}
+	if w.UserProfile != nil {
+		p.User = w.UserProfile.LoginName
+	}
+	return p
+}
+
+type peerIdentityKey struct{}
+
+// WithPeerIdentity returns a copy of ctx that carries the peer identity.
+func WithPeerIdentity(ctx context.Context, p *PeerIdentity) context.Context {
+	return context.WithValue(ctx, peerIdentityKey{}, p)
+}
+
+// PeerIdentityFromContext returns the peer identity stored in ctx or nil if there is none.
+func PeerIdentityFromContext(ctx context.Context) *PeerIdentity {
+	p, _ := ctx.Value(peerIdentityKey{}).(*PeerIdentity)
+	return p
+}
@@ -1,9 +1,13 @@
 package util
 
 import (
+	"github.com/cockroachdb/errors"
 	"os"
+	"path/filepath"
 )
 
+var ErrUnsafePath = errors.New("path escapes the base directory")
+
 func EnsureFolderExists(p string) error {
 	_, err := os.Stat(p)
 	if err != nil {
@@ -18,3 +22,15 @@ func EnsureFolderExists(p string) error {
 	}
 	return nil
 }
+
+// SafeJoin joins the elements to base like filepath.Join.
+// It fails with ErrUnsafePath if the result would not be inside base,
+// e.g. because an element is `..` or an absolute path.
+func SafeJoin(base string, elem ...string) (string, error) {
+	for _, e := range elem {
+		if !filepath.IsLocal(e) {
+			return "", errors.Wrapf(ErrUnsafePath, "%q", e)
+		}
+	}
+	return filepath.Join(base, filepath.Join(elem...)), nil
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"github.com/cockroachdb/errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		elem []string
+		out  string
+		err  error
+	}{
+		{elem: []string{"tailnode.log.tailscale.io", "abc"}, out: filepath.Join("logs", "tailnode.log.tailscale.io", "abc")},
+		{elem: []string{"a.b", "c"}, out: filepath.Join("logs", "a.b", "c")},
+		{elem: []string{"..", "abc"}, err: ErrUnsafePath},
+		{elem: []string{".", "abc"}, out: filepath.Join("logs", "abc")},
+		{elem: []string{"a/../..", "abc"}, err: ErrUnsafePath},
+		{elem: []string{"/etc", "passwd"}, err: ErrUnsafePath},
+		{elem: []string{"", "abc"}, err: ErrUnsafePath},
+	}
+
+	for _, tc := range tests {
+		t.Run(filepath.Join(tc.elem...), func(t *testing.T) {
+			out, err := SafeJoin("logs", tc.elem...)
+			if !errors.Is(err, tc.err) || out != tc.out {
+				t.Fatalf(`SafeJoin("logs", %q) = "%s", %v, want "%s", %v`, tc.elem, out, err, tc.out, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"github.com/cockroachdb/errors"
+	"io"
+)
+
+var ErrTooLarge = errors.New("size limit exceeded")
+
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+	// read one byte more than allowed to detect if the limit is exceeded
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// NewLimitReader returns a reader that fails with ErrTooLarge once more than n bytes are read from r.
+// Unlike io.LimitReader exceeding the limit is an error.
+func NewLimitReader(r io.Reader, n int64) io.Reader {
+	return &limitReader{r, n}
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"bytes"
+	"github.com/cockroachdb/errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"testing"
+)
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		in    string
+		limit int64
+		err   error
+	}{
+		{in: "", limit: 0, err: nil},
+		{in: "1234", limit: 4, err: nil},
+		{in: "1234", limit: 10, err: nil},
+		{in: "1234", limit: 3, err: ErrTooLarge},
+		{in: "1234", limit: 0, err: ErrTooLarge},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			b, err := io.ReadAll(NewLimitReader(bytes.NewReader([]byte(tc.in)), tc.limit))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf(`ReadAll(NewLimitReader("%s", %d)) = %s, want %s`, tc.in, tc.limit, err, tc.err)
+			}
+			if err == nil && string(b) != tc.in {
+				t.Fatalf(`ReadAll(NewLimitReader("%s", %d)) = "%s", want "%s"`, tc.in, tc.limit, b, tc.in)
+			}
+		})
+	}
+}
+
+func TestZstdReaderLimit(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// highly compressible, decompresses to 1 MiB
+	compressed := encoder.EncodeAll(bytes.Repeat([]byte{'a'}, 1<<20), nil)
+
+	zr, err := NewZstdReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	_, err = io.ReadAll(NewLimitReader(zr, 1<<10))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf(`decoding with limit = %s, want %s`, err, ErrTooLarge)
+	}
+
+	zr, err = NewZstdReader(bytes.NewReader([]byte("not zstd")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if _, err := io.ReadAll(zr); err == nil {
+		t.Fatalf(`decoding invalid data succeeded, want error`)
+	}
+}
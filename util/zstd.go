@@ -2,20 +2,45 @@ package util
 
 import (
 	"github.com/klauspost/compress/zstd"
+	"io"
 	"sync"
 	"tailscale.com/smallzstd"
 )
 
-func ZstdDecode(in []byte) []byte {
+type zstdReader struct {
+	decoder *zstd.Decoder
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	if z.decoder == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return z.decoder.Read(p)
+}
+
+// Close returns the decoder to the pool. It does not close the underlying reader.
+func (z *zstdReader) Close() error {
+	if z.decoder == nil {
+		return nil
+	}
+	_ = z.decoder.Reset(nil)
+	zstdDecoderPool.Put(z.decoder)
+	z.decoder = nil
+	return nil
+}
+
+// NewZstdReader returns a reader that decompresses the zstd stream r.
+func NewZstdReader(r io.Reader) (io.ReadCloser, error) {
 	decoder, ok := zstdDecoderPool.Get().(*zstd.Decoder)
 	if !ok {
 		panic("invalid type in sync pool")
 	}
-	out, _ := decoder.DecodeAll(in, nil)
-	_ = decoder.Reset(nil)
-	zstdDecoderPool.Put(decoder)
-
-	return out
+	err := decoder.Reset(r)
+	if err != nil {
+		zstdDecoderPool.Put(decoder)
+		return nil, err
+	}
+	return &zstdReader{decoder}, nil
 }
 
 var zstdDecoderPool = &sync.Pool{